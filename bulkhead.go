@@ -0,0 +1,92 @@
+package nf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrBulkheadFull is returned (wrapped) by Bulkhead.Acquire when no slot became available in time.
+var ErrBulkheadFull = errors.New("Bulkhead is full")
+
+// Bulkhead limits the number of concurrent calls to a dependency, so that a slow dependency ties up at most
+// that many of our goroutines (and connections), instead of all of them.
+// The number of calls in flight is exported as the metric nf_bulkhead_in_flight.
+// Use NewBulkhead to create a bulkhead. The zero value has no limit.
+type Bulkhead struct {
+	Name    string
+	MaxWait time.Duration // How long a call may wait for a free slot. If zero, then calls beyond the limit are rejected immediately.
+
+	slots chan struct{}
+}
+
+var (
+	bulkheadCapacity   = DefaultMetrics.NewGauge("nf_bulkhead_capacity", "Maximum number of concurrent calls allowed by the bulkhead.", "name")
+	bulkheadInFlight   = DefaultMetrics.NewGauge("nf_bulkhead_in_flight", "Number of calls currently inside the bulkhead.", "name")
+	bulkheadRejections = DefaultMetrics.NewCounter("nf_bulkhead_rejections_total", "Number of calls rejected because the bulkhead was full.", "name")
+)
+
+// NewBulkhead creates a bulkhead that allows maxConcurrent calls at a time. A call beyond the limit waits up to
+// maxWait for a free slot.
+func NewBulkhead(name string, maxConcurrent int, maxWait time.Duration) *Bulkhead {
+	if maxConcurrent < 1 {
+		panic("Bulkhead must allow at least one concurrent call")
+	}
+	bulkheadCapacity.Set(float64(maxConcurrent), name)
+	return &Bulkhead{
+		Name:    name,
+		MaxWait: maxWait,
+		slots:   make(chan struct{}, maxConcurrent),
+	}
+}
+
+// Acquire waits for a free slot, and returns the function that frees it again. If no slot becomes available
+// within MaxWait, then the error wraps ErrBulkheadFull. If ctx is done first, then the error is ctx.Err().
+func (b *Bulkhead) Acquire(ctx context.Context) (release func(), err error) {
+	if b.slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case b.slots <- struct{}{}:
+	default:
+		if b.MaxWait <= 0 {
+			bulkheadRejections.Inc(b.Name)
+			return nil, fmt.Errorf("%w: %v", ErrBulkheadFull, b.Name)
+		}
+		timer := time.NewTimer(b.MaxWait)
+		defer timer.Stop()
+		select {
+		case b.slots <- struct{}{}:
+		case <-timer.C:
+			bulkheadRejections.Inc(b.Name)
+			return nil, fmt.Errorf("%w: %v", ErrBulkheadFull, b.Name)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	bulkheadInFlight.Inc(b.Name)
+	once := sync.Once{}
+	return func() {
+		once.Do(func() {
+			bulkheadInFlight.Dec(b.Name)
+			<-b.slots
+		})
+	}, nil
+}
+
+// Do runs fn inside the bulkhead. See Acquire for the errors that are returned without running fn.
+func (b *Bulkhead) Do(ctx context.Context, fn func() error) error {
+	release, err := b.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return fn()
+}
+
+// InFlight returns the number of calls currently inside the bulkhead.
+func (b *Bulkhead) InFlight() int {
+	return len(b.slots)
+}
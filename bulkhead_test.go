@@ -0,0 +1,62 @@
+package nf
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestBulkhead(t *testing.T) {
+	b := NewBulkhead("test-gis", 2, 20*time.Millisecond)
+	release1, err := b.Acquire(context.Background())
+	assert.NilError(t, err)
+	release2, err := b.Acquire(context.Background())
+	assert.NilError(t, err)
+	assert.Equal(t, b.InFlight(), 2)
+
+	// Full, so we wait for MaxWait, and then give up
+	start := time.Now()
+	_, err = b.Acquire(context.Background())
+	assert.Assert(t, errors.Is(err, ErrBulkheadFull))
+	assert.Assert(t, time.Since(start) >= 20*time.Millisecond)
+
+	// A cancelled context stops the wait
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = b.Acquire(ctx)
+	assert.Equal(t, err, context.Canceled)
+
+	// A slot that is freed while we wait is taken
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		release1()
+	}()
+	assert.NilError(t, b.Do(context.Background(), func() error {
+		assert.Equal(t, b.InFlight(), 2)
+		return nil
+	}))
+	release1() // Releasing twice has no effect
+	assert.Equal(t, b.InFlight(), 1)
+
+	buf := bytes.Buffer{}
+	DefaultMetrics.WriteText(&buf)
+	assert.Assert(t, strings.Contains(buf.String(), `nf_bulkhead_in_flight{name="test-gis"} 1`))
+	assert.Assert(t, strings.Contains(buf.String(), `nf_bulkhead_capacity{name="test-gis"} 2`))
+	assert.Assert(t, strings.Contains(buf.String(), `nf_bulkhead_rejections_total{name="test-gis"} 1`))
+	release2()
+	assert.Equal(t, b.InFlight(), 0)
+}
+
+func TestBulkheadZero(t *testing.T) {
+	// The zero value has no limit
+	b := &Bulkhead{}
+	for i := 0; i < 3; i++ {
+		_, err := b.Acquire(context.Background())
+		assert.NilError(t, err)
+	}
+}
@@ -0,0 +1,267 @@
+package nf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned (wrapped) by CircuitBreaker.Allow when the circuit is open.
+var ErrCircuitOpen = errors.New("Circuit breaker is open")
+
+// CircuitState is the state of a CircuitBreaker
+type CircuitState int
+
+const (
+	CircuitClosed   CircuitState = iota // Requests flow normally
+	CircuitOpen                         // Requests fail immediately
+	CircuitHalfOpen                     // A few trial requests are allowed through, to see if the dependency has recovered
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// CircuitBreaker stops us from calling a dependency that is failing, so that our own requests fail fast instead of
+// queuing up behind timeouts. After FailureThreshold consecutive failures the circuit opens, and after OpenTimeout
+// it becomes half-open, which allows HalfOpenRequests trial requests through. Once SuccessThreshold trials have
+// succeeded the circuit closes, but a single failed trial opens it again.
+//
+// A CircuitBreaker can be used around anything that may fail: Client.Breaker, AuthBreaker, or CircuitBreaker.Do
+// around your own calls (eg to the database, with nfdb.IsUnavailable as IsFailure).
+// The state of every breaker that has been used is exported as the metric nf_circuit_breaker_state, and HealthCheck
+// returns a check that fails while the circuit is open.
+type CircuitBreaker struct {
+	Name             string
+	FailureThreshold int           // If zero, then 5
+	OpenTimeout      time.Duration // If zero, then 30 seconds
+	HalfOpenRequests int           // Maximum number of concurrent trial requests while half-open. If zero, then 1.
+	SuccessThreshold int           // Number of successful trials that close the circuit. If zero, then 1.
+
+	// IsFailure decides whether an error passed to Report counts against the dependency.
+	// If nil, then every error is a failure. Return false for errors such as "record not found".
+	IsFailure func(err error) bool
+
+	lock      sync.Mutex
+	state     CircuitState
+	failures  int // Consecutive failures while closed
+	successes int // Successful trials while half-open
+	trials    int // Trials in flight while half-open
+	openedAt  time.Time
+	register  sync.Once
+}
+
+var (
+	circuitRejections = DefaultMetrics.NewCounter("nf_circuit_breaker_rejections_total", "Number of calls rejected because the circuit was open.", "name")
+	circuitOpenings   = DefaultMetrics.NewCounter("nf_circuit_breaker_opened_total", "Number of times the circuit has opened.", "name")
+
+	breakersLock sync.Mutex
+	breakers     []*CircuitBreaker
+)
+
+// NewCircuitBreaker creates a circuit breaker with the default thresholds.
+func NewCircuitBreaker(name string) *CircuitBreaker {
+	return &CircuitBreaker{Name: name}
+}
+
+// Allow returns an error wrapping ErrCircuitOpen if a request must not be made. Otherwise, the outcome of the
+// request must be reported with Success, Failure or Report.
+func (b *CircuitBreaker) Allow() error {
+	b.register.Do(func() { registerBreaker(b) })
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch b.state {
+	case CircuitOpen:
+		if time.Since(b.openedAt) < b.openTimeout() {
+			circuitRejections.Inc(b.Name)
+			return fmt.Errorf("%w: %v", ErrCircuitOpen, b.Name)
+		}
+		b.state = CircuitHalfOpen
+		b.successes = 0
+		b.trials = 1
+	case CircuitHalfOpen:
+		if b.trials >= max(b.HalfOpenRequests, 1) {
+			circuitRejections.Inc(b.Name)
+			return fmt.Errorf("%w: %v", ErrCircuitOpen, b.Name)
+		}
+		b.trials++
+	}
+	return nil
+}
+
+// Success reports a successful request.
+func (b *CircuitBreaker) Success() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch b.state {
+	case CircuitClosed:
+		b.failures = 0
+	case CircuitHalfOpen:
+		b.endTrial()
+		b.successes++
+		if b.successes >= max(b.SuccessThreshold, 1) {
+			b.state = CircuitClosed
+			b.failures = 0
+		}
+	}
+}
+
+// Failure reports a failed request.
+func (b *CircuitBreaker) Failure() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch b.state {
+	case CircuitClosed:
+		b.failures++
+		if b.failures >= b.failureThreshold() {
+			b.open()
+		}
+	case CircuitHalfOpen:
+		b.endTrial()
+		b.open()
+	}
+}
+
+// Report reports the outcome of a request, based on its error: nil is a success, and so is an error for which
+// IsFailure returns false. A cancelled context means that the caller gave up, so the outcome is unknown.
+func (b *CircuitBreaker) Report(err error) {
+	switch {
+	case err == nil:
+		b.Success()
+	case errors.Is(err, context.Canceled):
+		b.abandon()
+	case b.IsFailure != nil && !b.IsFailure(err):
+		b.Success()
+	default:
+		b.Failure()
+	}
+}
+
+// Do runs fn if the circuit allows it, and reports its outcome. A panic is re-raised after being reported
+// as a failure, unless it is an HTTPError with a status code below 500.
+func (b *CircuitBreaker) Do(fn func() error) error {
+	if err := b.Allow(); err != nil {
+		return err
+	}
+	returned := false
+	defer func() {
+		if !returned {
+			rec := recover()
+			if hErr, ok := rec.(HTTPError); ok && hErr.Code < 500 {
+				b.Success()
+			} else {
+				b.Failure()
+			}
+			panic(rec)
+		}
+	}()
+	err := fn()
+	returned = true
+	b.Report(err)
+	return err
+}
+
+// abandon reports a request whose outcome is unknown, because the caller gave up on it
+func (b *CircuitBreaker) abandon() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.state == CircuitHalfOpen {
+		b.endTrial()
+	}
+}
+
+// State returns the current state of the circuit.
+func (b *CircuitBreaker) State() CircuitState {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.state == CircuitOpen && time.Since(b.openedAt) >= b.openTimeout() {
+		return CircuitHalfOpen
+	}
+	return b.state
+}
+
+// HealthCheck returns a readiness check that fails while the circuit is open.
+// Register it with DefaultHealth.Add if the service is of no use while the dependency is down.
+func (b *CircuitBreaker) HealthCheck() HealthCheck {
+	return HealthCheck{
+		Name: "circuit:" + b.Name,
+		Kind: HealthReadiness,
+		Check: func(ctx context.Context) error {
+			if b.State() == CircuitOpen {
+				return fmt.Errorf("%w: %v", ErrCircuitOpen, b.Name)
+			}
+			return nil
+		},
+	}
+}
+
+func (b *CircuitBreaker) open() {
+	b.state = CircuitOpen
+	b.openedAt = time.Now()
+	circuitOpenings.Inc(b.Name)
+}
+
+// endTrial must be called with the lock held, when a trial request of the half-open state finishes
+func (b *CircuitBreaker) endTrial() {
+	if b.trials > 0 {
+		b.trials--
+	}
+}
+
+func (b *CircuitBreaker) failureThreshold() int {
+	if b.FailureThreshold == 0 {
+		return 5
+	}
+	return b.FailureThreshold
+}
+
+func (b *CircuitBreaker) openTimeout() time.Duration {
+	if b.OpenTimeout == 0 {
+		return 30 * time.Second
+	}
+	return b.OpenTimeout
+}
+
+// registerBreaker adds b to the breakers that are reported by nf_circuit_breaker_state
+func registerBreaker(b *CircuitBreaker) {
+	breakersLock.Lock()
+	defer breakersLock.Unlock()
+	if len(breakers) == 0 {
+		DefaultMetrics.addCollector(writeBreakerMetrics)
+	}
+	breakers = append(breakers, b)
+}
+
+func writeBreakerMetrics(w io.Writer) {
+	breakersLock.Lock()
+	all := append([]*CircuitBreaker{}, breakers...)
+	breakersLock.Unlock()
+	// Breakers that share a name are reported as one series, in the worst of their states
+	names := []string{}
+	states := map[string]CircuitState{}
+	for _, b := range all {
+		state := b.State()
+		current, seen := states[b.Name]
+		if !seen {
+			names = append(names, b.Name)
+		}
+		if !seen || state == CircuitOpen || (state == CircuitHalfOpen && current == CircuitClosed) {
+			states[b.Name] = state
+		}
+	}
+	writeMetricHeader(w, "nf_circuit_breaker_state", "gauge", "State of the circuit breaker (0 = closed, 1 = open, 2 = half-open).")
+	for _, name := range names {
+		fmt.Fprintf(w, "nf_circuit_breaker_state%v %v\n", formatLabels([]string{"name"}, []string{name}), int(states[name]))
+	}
+}
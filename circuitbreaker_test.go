@@ -0,0 +1,92 @@
+package nf
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	notFound := errors.New("not found")
+	down := errors.New("connection refused")
+	b := &CircuitBreaker{
+		Name:             "test-db",
+		FailureThreshold: 3,
+		OpenTimeout:      20 * time.Millisecond,
+		HalfOpenRequests: 2,
+		SuccessThreshold: 2,
+		IsFailure:        func(err error) bool { return err != notFound },
+	}
+	fail := func() error { return down }
+	ok := func() error { return nil }
+
+	// Errors that aren't failures, and successes, reset the count
+	assert.Equal(t, b.Do(fail), down)
+	assert.Equal(t, b.Do(fail), down)
+	assert.Equal(t, b.Do(func() error { return notFound }), notFound)
+	assert.Equal(t, b.Do(fail), down)
+	assert.Equal(t, b.Do(fail), down)
+	assert.Equal(t, b.State(), CircuitClosed)
+	assert.Equal(t, b.Do(fail), down)
+	assert.Equal(t, b.State(), CircuitOpen)
+	assert.Assert(t, errors.Is(b.Do(ok), ErrCircuitOpen))
+
+	health := b.HealthCheck()
+	assert.ErrorContains(t, health.Check(context.Background()), "Circuit breaker is open: test-db")
+	buf := bytes.Buffer{}
+	DefaultMetrics.WriteText(&buf)
+	assert.Assert(t, strings.Contains(buf.String(), `nf_circuit_breaker_state{name="test-db"} 1`))
+	assert.Assert(t, strings.Contains(buf.String(), `nf_circuit_breaker_rejections_total{name="test-db"} 1`))
+
+	// Half-open allows a limited number of trials, and a failed trial opens the circuit again
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, b.State(), CircuitHalfOpen)
+	assert.NilError(t, health.Check(context.Background()))
+	assert.NilError(t, b.Allow())
+	assert.NilError(t, b.Allow())
+	assert.Assert(t, errors.Is(b.Allow(), ErrCircuitOpen))
+	b.Success()
+	b.Failure()
+	assert.Equal(t, b.State(), CircuitOpen)
+
+	// Enough successful trials close the circuit
+	time.Sleep(30 * time.Millisecond)
+	assert.NilError(t, b.Do(ok))
+	assert.Equal(t, b.State(), CircuitHalfOpen)
+	assert.NilError(t, b.Do(ok))
+	assert.Equal(t, b.State(), CircuitClosed)
+
+	// A panic with a client error does not count as a failure, but other panics do
+	b.FailureThreshold = 1
+	func() {
+		defer func() { recover() }()
+		b.Do(func() error { PanicBadRequest(); return nil })
+	}()
+	assert.Equal(t, b.State(), CircuitClosed)
+	func() {
+		defer func() { recover() }()
+		b.Do(func() error { panic(HTTPError{http.StatusInternalServerError, "oops"}) })
+	}()
+	assert.Equal(t, b.State(), CircuitOpen)
+}
+
+func TestCircuitBreakerSameName(t *testing.T) {
+	a := &CircuitBreaker{Name: "test-shared", FailureThreshold: 1}
+	b := &CircuitBreaker{Name: "test-shared", FailureThreshold: 1}
+	assert.NilError(t, a.Allow())
+	a.Success()
+	assert.NilError(t, b.Allow())
+	b.Failure()
+
+	// Only one series for the name, in the worst state
+	buf := bytes.Buffer{}
+	DefaultMetrics.WriteText(&buf)
+	assert.Equal(t, strings.Count(buf.String(), `nf_circuit_breaker_state{name="test-shared"}`), 1)
+	assert.Assert(t, strings.Contains(buf.String(), `nf_circuit_breaker_state{name="test-shared"} 1`))
+}
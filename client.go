@@ -0,0 +1,320 @@
+package nf
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RequestIDHeader identifies a request as it travels between services, so that log messages can be correlated.
+const RequestIDHeader = "X-Request-ID"
+
+// RequestTimeoutHeader carries the time (in milliseconds) that the caller is prepared to wait for a response.
+// An authenticated route registered through nf shortens its own deadline to match (see Timeout), so that an upstream
+// service doesn't keep working on a request that nobody is waiting for. The header is only honoured when the caller
+// authenticated as another service (ie with InterServiceAuth), and not when it forwarded a user's credentials.
+const RequestTimeoutHeader = "X-Request-Timeout"
+
+// UpstreamError is returned by Client.Do when the upstream service responds with a status code of 400 or higher.
+type UpstreamError struct {
+	Method string
+	URL    string
+	Status int
+	Body   string // The start of the response body
+}
+
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("%v %v failed with %v: %v", e.Method, e.URL, e.Status, e.Body)
+}
+
+// Client calls other services over HTTP. Requests are made on behalf of the incoming request that is passed to
+// Do or Call: its authentication is forwarded, along with its request ID and deadline.
+// A Client is safe for concurrent use, once its fields have been set.
+type Client struct {
+	BaseURL        string        // Prefix of every path, eg "http://127.0.0.1:2500/gis"
+	HTTP           *http.Client  // If nil, then http.DefaultClient
+	Timeout        time.Duration // Limits the whole call, including retries. If zero, then only the context deadline applies.
+	Retries        int           // Number of retries after a failed attempt. Only idempotent requests are retried (see IdempotentPOST).
+	RetryBackoff   time.Duration // Wait before the first retry. This doubles with every retry. If zero, then 100 milliseconds.
+	MaxRetryWait   time.Duration // Longest wait before a retry. If upstream asks us (with Retry-After) to wait longer, then we give up instead. If zero, then 10 seconds.
+	Breaker        *CircuitBreaker
+	Bulkhead       *Bulkhead // Limits the number of concurrent calls. If nil, then there is no limit.
+	ForwardCookies []string  // Cookies of the incoming request that are forwarded. If empty, then "session".
+
+	// InterServiceAuth adds inter-service credentials to req. It is used when the call is not made on behalf of
+	// a user, ie when the incoming request is nil, or it has no credentials of its own.
+	InterServiceAuth func(req *http.Request) error
+
+	// If IdempotentPOST is true, then POST requests carry an Idempotency-Key header (the same key for every attempt
+	// of a call), which allows them to be retried. The upstream route must have the Idempotent option.
+	IdempotentPOST bool
+}
+
+// NewClient returns a Client for the service at baseURL, with 2 retries.
+func NewClient(baseURL string) *Client {
+	return &Client{
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		Retries: 2,
+	}
+}
+
+// Do sends a request to BaseURL + path, on behalf of the incoming request in (which may be nil).
+// body is encoded as JSON, unless it is nil. If out is not nil, then the response body is decoded into it
+// as JSON, or copied into it if out is a *[]byte.
+// A response status of 400 or higher is returned as an *UpstreamError. If the circuit breaker is open, then
+// the error wraps ErrCircuitOpen, and if the bulkhead is full, then it wraps ErrBulkheadFull.
+func (c *Client) Do(ctx context.Context, in *http.Request, method, path string, body, out interface{}) error {
+	var content []byte
+	if body != nil {
+		var err error
+		if content, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	if c.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	idempotencyKey := ""
+	if method == "POST" && c.IdempotentPOST {
+		idempotencyKey = newRandomToken()
+	}
+	requestID := ""
+	if in != nil {
+		requestID = in.Header.Get(RequestIDHeader)
+	}
+	if requestID == "" {
+		requestID = newRandomToken()
+	}
+
+	backoff := c.RetryBackoff
+	if backoff == 0 {
+		backoff = 100 * time.Millisecond
+	}
+	maxWait := c.MaxRetryWait
+	if maxWait == 0 {
+		maxWait = 10 * time.Second
+	}
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, bytes.NewReader(content))
+		if err != nil {
+			return err
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set(RequestIDHeader, requestID)
+		if idempotencyKey != "" {
+			req.Header.Set("Idempotency-Key", idempotencyKey)
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			req.Header.Set(RequestTimeoutHeader, strconv.FormatInt(time.Until(deadline).Milliseconds(), 10))
+		}
+		if err := c.authorize(req, in); err != nil {
+			return err
+		}
+
+		retryAfter, err := c.attempt(req, out)
+		if err == nil || attempt >= c.Retries || retryAfter < 0 || !(isIdempotentMethod(method) || idempotencyKey != "") {
+			return err
+		}
+		if retryAfter > maxWait {
+			return err
+		}
+		wait := backoff
+		for i := 0; i < attempt && wait < maxWait; i++ {
+			wait *= 2
+		}
+		wait = min(wait/2+rand.N(wait), maxWait)
+		if retryAfter > wait {
+			wait = retryAfter
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+	}
+}
+
+// attempt sends req once. If the attempt failed, then retryAfter is the minimum wait before a retry
+// (which may be zero), or -1 if the failure is not worth retrying.
+func (c *Client) attempt(req *http.Request, out interface{}) (retryAfter time.Duration, err error) {
+	if c.Bulkhead != nil {
+		release, err := c.Bulkhead.Acquire(req.Context())
+		if err != nil {
+			return -1, err
+		}
+		defer release()
+	}
+	if c.Breaker != nil {
+		if err := c.Breaker.Allow(); err != nil {
+			return -1, err
+		}
+	}
+	httpClient := c.HTTP
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		if c.Breaker != nil {
+			if errors.Is(err, context.Canceled) {
+				c.Breaker.abandon()
+			} else {
+				c.Breaker.Failure()
+			}
+		}
+		if req.Context().Err() != nil {
+			return -1, err
+		}
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		if c.Breaker != nil {
+			if resp.StatusCode >= 500 {
+				c.Breaker.Failure()
+			} else {
+				c.Breaker.Success()
+			}
+		}
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		err = &UpstreamError{
+			Method: req.Method,
+			URL:    req.URL.Redacted(),
+			Status: resp.StatusCode,
+			Body:   strings.TrimSpace(string(msg)),
+		}
+		switch resp.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return parseRetryAfter(resp.Header.Get("Retry-After")), err
+		}
+		return -1, err
+	}
+
+	if out != nil {
+		if raw, ok := out.(*[]byte); ok {
+			*raw, err = io.ReadAll(resp.Body)
+		} else {
+			err = json.NewDecoder(resp.Body).Decode(out)
+		}
+	}
+	if c.Breaker != nil {
+		c.Breaker.Success()
+	}
+	if err != nil {
+		return -1, fmt.Errorf("Failed to read response of %v %v: %w", req.Method, req.URL.Redacted(), err)
+	}
+	return -1, nil
+}
+
+// authorize forwards the credentials of the incoming request to req, or adds inter-service credentials
+func (c *Client) authorize(req *http.Request, in *http.Request) error {
+	forwarded := false
+	if in != nil {
+		if auth := in.Header.Get("Authorization"); auth != "" {
+			req.Header.Set("Authorization", auth)
+			forwarded = true
+		}
+		cookies := c.ForwardCookies
+		if len(cookies) == 0 {
+			cookies = []string{"session"}
+		}
+		for _, name := range cookies {
+			if cookie, err := in.Cookie(name); err == nil {
+				req.AddCookie(cookie)
+				forwarded = true
+			}
+		}
+	}
+	if !forwarded && c.InterServiceAuth != nil {
+		return c.InterServiceAuth(req)
+	}
+	return nil
+}
+
+// Call is Do, on behalf of in, except that a failure panics with an HTTPError (see UpstreamHTTPError).
+// in may be nil, for a call that is not made on behalf of a user.
+func (c *Client) Call(in *http.Request, method, path string, body, out interface{}) {
+	ctx := context.Background()
+	if in != nil {
+		ctx = in.Context()
+	}
+	if err := c.Do(ctx, in, method, path, body, out); err != nil {
+		if ctx.Err() == context.Canceled {
+			// The client has gone away. runProtected sends the appropriate response.
+			panic(err)
+		}
+		panic(UpstreamHTTPError(err))
+	}
+}
+
+// GetJSON calls GET path on behalf of in, and decodes the response into out. A failure panics with an HTTPError.
+func (c *Client) GetJSON(in *http.Request, path string, out interface{}) {
+	c.Call(in, "GET", path, nil, out)
+}
+
+// PostJSON calls POST path on behalf of in, with body encoded as JSON, and decodes the response into out (if not nil).
+// A failure panics with an HTTPError.
+func (c *Client) PostJSON(in *http.Request, path string, body, out interface{}) {
+	c.Call(in, "POST", path, body, out)
+}
+
+// UpstreamHTTPError converts an error from Client.Do into the HTTPError that we send to our own client.
+// A 4xx from upstream is passed through, because it is most likely caused by our client's request (eg 403 or 404).
+// A 5xx from upstream, or a failure to connect, becomes 502 Bad Gateway. A timeout becomes 504 Gateway Timeout,
+// and an open circuit breaker or a full bulkhead becomes 503 Service Unavailable.
+func UpstreamHTTPError(err error) HTTPError {
+	var upstream *UpstreamError
+	switch {
+	case errors.As(err, &upstream) && upstream.Status < 500:
+		return HTTPError{upstream.Status, upstream.Body}
+	case errors.As(err, &upstream):
+		return HTTPError{http.StatusBadGateway, err.Error()}
+	case errors.Is(err, ErrCircuitOpen), errors.Is(err, ErrBulkheadFull):
+		return HTTPError{http.StatusServiceUnavailable, err.Error()}
+	case errors.Is(err, context.DeadlineExceeded):
+		return HTTPError{http.StatusGatewayTimeout, err.Error()}
+	}
+	return HTTPError{http.StatusBadGateway, err.Error()}
+}
+
+// parseRetryAfter returns the wait in a Retry-After header, which is either a number of seconds, or an HTTP date.
+// If the header is missing or invalid, then the wait is zero.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return max(time.Duration(seconds)*time.Second, 0)
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0)
+	}
+	return 0
+}
+
+// isIdempotentMethod returns true if a request with the given method can safely be repeated
+func isIdempotentMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
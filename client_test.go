@@ -0,0 +1,181 @@
+package nf
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"gotest.tools/v3/assert"
+)
+
+func TestClient(t *testing.T) {
+	var failures atomic.Int32
+	var lastHeader http.Header
+	router := httprouter.New()
+	Handle(router, "GET", "/assets/:id", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		lastHeader = r.Header.Clone()
+		if failures.Add(-1) >= 0 {
+			Panic(http.StatusServiceUnavailable, "database is down")
+		}
+		if p.ByName("id") == "0" {
+			PanicNotFoundf("No such asset")
+		}
+		deadline, ok := r.Context().Deadline()
+		SendJSON(w, map[string]interface{}{"ID": ParseID(p.ByName("id")), "HasDeadline": ok && time.Until(deadline) <= time.Second})
+	})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	client := NewClient(server.URL)
+	client.RetryBackoff = time.Millisecond
+	client.InterServiceAuth = func(req *http.Request) error {
+		req.Header.Set("Authorization", "interservice")
+		return nil
+	}
+
+	type asset struct {
+		ID          int64
+		HasDeadline bool
+	}
+
+	// Credentials, request ID and deadline are forwarded
+	in := httptest.NewRequest("GET", "/", nil)
+	in.Header.Set(RequestIDHeader, "abc")
+	in.AddCookie(&http.Cookie{Name: "session", Value: "xyz"})
+	in.AddCookie(&http.Cookie{Name: "other", Value: "123"})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	in = in.WithContext(ctx)
+	var a asset
+	client.GetJSON(in, "/assets/5", &a)
+	// The deadline is sent, but only another service is trusted to shorten ours (see TestCallerTimeout)
+	assert.Equal(t, a, asset{5, false})
+	assert.Assert(t, lastHeader.Get(RequestTimeoutHeader) != "")
+	assert.Equal(t, lastHeader.Get(RequestIDHeader), "abc")
+	assert.Equal(t, lastHeader.Get("Cookie"), "session=xyz")
+	assert.Equal(t, lastHeader.Get("Authorization"), "")
+
+	// Without a caller, we use inter-service credentials, and generate a request ID
+	assert.NilError(t, client.Do(context.Background(), nil, "GET", "/assets/6", nil, &a))
+	assert.Equal(t, lastHeader.Get("Authorization"), "interservice")
+	assert.Assert(t, lastHeader.Get(RequestIDHeader) != "")
+	assert.Assert(t, lastHeader.Get(RequestTimeoutHeader) == "")
+
+	// Temporary failures are retried
+	failures.Store(2)
+	assert.NilError(t, client.Do(context.Background(), in, "GET", "/assets/7", nil, &a))
+	assert.Equal(t, a.ID, int64(7))
+	failures.Store(3)
+	err := client.Do(context.Background(), in, "GET", "/assets/7", nil, &a)
+	var upstream *UpstreamError
+	assert.Assert(t, errors.As(err, &upstream))
+	assert.Equal(t, upstream.Status, http.StatusServiceUnavailable)
+	assert.Equal(t, UpstreamHTTPError(err).Code, http.StatusBadGateway)
+	failures.Store(0)
+
+	// Client errors are passed through, without retries
+	err = client.Do(context.Background(), in, "GET", "/assets/0", nil, &a)
+	assert.Equal(t, UpstreamHTTPError(err), HTTPError{http.StatusNotFound, "No such asset"})
+
+	// Upstream failures become HTTPErrors
+	callRouter := httprouter.New()
+	Handle(callRouter, "GET", "/proxy/:id", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		var a asset
+		client.GetJSON(r, "/assets/"+p.ByName("id"), &a)
+		SendID(w, a.ID)
+	})
+	call := func(id int) (int, string) {
+		rec := httptest.NewRecorder()
+		callRouter.ServeHTTP(rec, httptest.NewRequest("GET", "/proxy/"+strconv.Itoa(id), nil))
+		return rec.Code, rec.Body.String()
+	}
+	code, body := call(8)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, body, "8")
+	code, _ = call(0)
+	assert.Equal(t, code, http.StatusNotFound)
+
+	// The circuit breaker opens after consecutive failures, and fails fast until it is half-open
+	client.Retries = 0
+	client.Breaker = &CircuitBreaker{Name: "assets", FailureThreshold: 2, OpenTimeout: 50 * time.Millisecond}
+	failures.Store(2)
+	code, _ = call(9)
+	assert.Equal(t, code, http.StatusBadGateway)
+	code, _ = call(9)
+	assert.Equal(t, code, http.StatusBadGateway)
+	code, body = call(9)
+	assert.Equal(t, code, http.StatusServiceUnavailable)
+	assert.Equal(t, body, "Circuit breaker is open: assets\n")
+	assert.Equal(t, client.Breaker.State(), CircuitOpen)
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, client.Breaker.State(), CircuitHalfOpen)
+	code, _ = call(9)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, client.Breaker.State(), CircuitClosed)
+}
+
+func TestClientTimeout(t *testing.T) {
+	release := make(chan struct{})
+	router := httprouter.New()
+	Handle(router, "GET", "/slow", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		<-release
+	})
+	server := httptest.NewServer(router)
+	defer server.Close()
+	defer close(release)
+
+	client := NewClient(server.URL)
+	client.Timeout = 50 * time.Millisecond
+	start := time.Now()
+	err := client.Do(context.Background(), nil, "GET", "/slow", nil, nil)
+	assert.Equal(t, UpstreamHTTPError(err).Code, http.StatusGatewayTimeout)
+	assert.Assert(t, time.Since(start) < time.Second)
+}
+
+func TestClientRetryAfter(t *testing.T) {
+	var attempts atomic.Int32
+	router := httprouter.New()
+	Handle(router, "GET", "/busy", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		attempts.Add(1)
+		w.Header().Set("Retry-After", "3600")
+		Panic(http.StatusServiceUnavailable, "Come back later")
+	})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	// We don't wait an hour for upstream, even without a deadline
+	client := NewClient(server.URL)
+	start := time.Now()
+	err := client.Do(context.Background(), nil, "GET", "/busy", nil, nil)
+	assert.Equal(t, UpstreamHTTPError(err).Code, http.StatusBadGateway)
+	assert.Equal(t, attempts.Load(), int32(1))
+	assert.Assert(t, time.Since(start) < time.Second)
+
+	// Our own backoff is capped, instead of cutting the retries short
+	var failures atomic.Int32
+	Handle(router, "GET", "/flaky", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if failures.Add(1) <= 8 {
+			Panic(http.StatusServiceUnavailable, "Not yet")
+		}
+		SendOK(w)
+	})
+	client.Retries = 8
+	client.RetryBackoff = time.Millisecond
+	client.MaxRetryWait = 5 * time.Millisecond
+	assert.NilError(t, client.Do(context.Background(), nil, "GET", "/flaky", nil, nil))
+	assert.Equal(t, failures.Load(), int32(9))
+
+	assert.Equal(t, parseRetryAfter(""), time.Duration(0))
+	assert.Equal(t, parseRetryAfter("5"), 5*time.Second)
+	assert.Equal(t, parseRetryAfter("-5"), time.Duration(0))
+	assert.Equal(t, parseRetryAfter("soon"), time.Duration(0))
+	assert.Equal(t, parseRetryAfter(time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)), time.Duration(0))
+	wait := parseRetryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	assert.Assert(t, wait > 58*time.Second && wait <= time.Minute, "wait is %v", wait)
+}
@@ -0,0 +1,270 @@
+package nf
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// CompressionConfig controls the gzip/deflate compression of responses.
+type CompressionConfig struct {
+	MinSize      int      // Responses smaller than this are sent uncompressed. If zero, then 1024.
+	ContentTypes []string // Prefixes of the content types that are compressed. If empty, then DefaultCompressibleTypes.
+	Level        int      // gzip/flate compression level. If zero, then gzip.DefaultCompression.
+}
+
+// DefaultCompressibleTypes are the content types that are compressed when CompressionConfig.ContentTypes is empty.
+// Formats that are already compressed (such as images and zip files) are deliberately absent.
+var DefaultCompressibleTypes = []string{
+	"text/",
+	"application/json",
+	"application/geo+json",
+	"application/javascript",
+	"application/xml",
+	"application/x-yaml",
+	"image/svg+xml",
+}
+
+// DefaultCompression is the compression of every route registered through nf, unless the route has its own Compress option.
+// If nil (the default), then responses are not compressed.
+// Like BypassAuth, this must be set before your routes are registered.
+var DefaultCompression *CompressionConfig
+
+// Compress sets the compression of a route, overriding DefaultCompression. Pass nil to disable compression.
+func Compress(config *CompressionConfig) RouteOption {
+	return func(r *Route) {
+		r.compression = config
+	}
+}
+
+func (c *CompressionConfig) minSize() int {
+	if c.MinSize == 0 {
+		return 1024
+	}
+	return c.MinSize
+}
+
+func (c *CompressionConfig) compressible(contentType string) bool {
+	types := c.ContentTypes
+	if len(types) == 0 {
+		types = DefaultCompressibleTypes
+	}
+	contentType = strings.ToLower(contentType)
+	for _, t := range types {
+		if strings.HasPrefix(contentType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsEncoding returns true if the Accept-Encoding header allows the given encoding (eg "gzip")
+func acceptsEncoding(header, encoding string) bool {
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(name, encoding) && name != "*" {
+			continue
+		}
+		params = strings.TrimSpace(params)
+		if q, ok := strings.CutPrefix(params, "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// newCompressWriter returns a writer that compresses the response, if the client supports it.
+// close must be called when the handler is finished.
+func (c *CompressionConfig) newCompressWriter(w http.ResponseWriter, r *http.Request) (writer http.ResponseWriter, close func()) {
+	w.Header().Add("Vary", "Accept-Encoding")
+	if r.Method == "HEAD" {
+		return w, func() {}
+	}
+	accept := r.Header.Get("Accept-Encoding")
+	encoding := ""
+	if acceptsEncoding(accept, "gzip") {
+		encoding = "gzip"
+	} else if acceptsEncoding(accept, "deflate") {
+		encoding = "deflate"
+	} else {
+		return w, func() {}
+	}
+	cw := &compressWriter{
+		ResponseWriter: w,
+		config:         c,
+		encoding:       encoding,
+	}
+	return cw, cw.close
+}
+
+// compressWriter buffers the start of the response, until it knows whether the response is big enough
+// to be worth compressing, and what its content type is.
+type compressWriter struct {
+	http.ResponseWriter
+	config   *CompressionConfig
+	encoding string
+	status   int
+	buf      []byte
+	decided  bool
+	cw       io.WriteCloser // nil if we decided not to compress
+}
+
+func (c *compressWriter) WriteHeader(code int) {
+	if c.decided {
+		c.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if c.status != 0 {
+		// Superfluous, just like it would be without us
+		return
+	}
+	c.status = code
+	if code == http.StatusNoContent || code == http.StatusNotModified {
+		c.decide(false)
+	}
+}
+
+func (c *compressWriter) Write(b []byte) (int, error) {
+	if c.decided {
+		if c.cw != nil {
+			return c.cw.Write(b)
+		}
+		return c.ResponseWriter.Write(b)
+	}
+	c.buf = append(c.buf, b...)
+	if len(c.buf) >= c.config.minSize() {
+		if err := c.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Flush sends whatever we have so far. A streaming response is compressed regardless of its size.
+func (c *compressWriter) Flush() {
+	if !c.decided {
+		c.decide(true)
+	}
+	if f, ok := c.cw.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap allows http.ResponseController to reach the original writer
+func (c *compressWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// decide sends the headers, and the buffered start of the response.
+// If bigEnough is false, then the response is not compressed.
+func (c *compressWriter) decide(bigEnough bool) error {
+	c.decided = true
+	h := c.Header()
+	if h.Get("Content-Type") == "" && len(c.buf) != 0 {
+		// This is what net/http would do if we weren't in the way
+		h.Set("Content-Type", http.DetectContentType(c.buf))
+	}
+	status := c.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	// A partial response must not be compressed, because Content-Range refers to the bytes of the uncompressed body
+	if bigEnough && status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified &&
+		status != http.StatusPartialContent && h.Get("Content-Range") == "" &&
+		h.Get("Content-Encoding") == "" && c.config.compressible(h.Get("Content-Type")) {
+		h.Set("Content-Encoding", c.encoding)
+		h.Del("Content-Length")
+		level := c.config.Level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		var err error
+		if c.encoding == "gzip" {
+			c.cw, err = gzip.NewWriterLevel(c.ResponseWriter, level)
+		} else {
+			c.cw, err = flate.NewWriter(c.ResponseWriter, level)
+		}
+		if err != nil {
+			// Invalid compression level
+			h.Del("Content-Encoding")
+			c.cw = nil
+		}
+	}
+	c.ResponseWriter.WriteHeader(status)
+	if len(c.buf) == 0 {
+		return nil
+	}
+	buf := c.buf
+	c.buf = nil
+	var err error
+	if c.cw != nil {
+		_, err = c.cw.Write(buf)
+	} else {
+		_, err = c.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+func (c *compressWriter) close() {
+	if !c.decided {
+		if c.status == 0 && len(c.buf) == 0 {
+			// The handler didn't send anything, so leave it up to net/http
+			return
+		}
+		c.decide(false)
+	}
+	if c.cw != nil {
+		c.cw.Close()
+	}
+}
+
+// servePrecompressed serves a pre-built .br or .gz sibling of the file at name, if the client accepts that
+// encoding and the sibling exists. Returns false if nothing was served.
+func servePrecompressed(w http.ResponseWriter, r *http.Request, fsys fs.FS, name string) bool {
+	accept := r.Header.Get("Accept-Encoding")
+	if accept == "" {
+		return false
+	}
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	for _, enc := range []struct{ ext, encoding string }{{".br", "br"}, {".gz", "gzip"}} {
+		if !acceptsEncoding(accept, enc.encoding) {
+			continue
+		}
+		f, err := fsys.Open(name + enc.ext)
+		if err != nil {
+			continue
+		}
+		defer f.Close()
+		st, err := f.Stat()
+		content, seekable := f.(io.ReadSeeker)
+		if err != nil || st.IsDir() || !seekable {
+			continue
+		}
+		ctype := mime.TypeByExtension(path.Ext(name))
+		if ctype == "" {
+			ctype = "application/octet-stream"
+		}
+		w.Header().Set("Content-Type", ctype)
+		w.Header().Set("Content-Encoding", enc.encoding)
+		if etag := w.Header().Get("ETag"); etag != "" {
+			// A different representation needs a different ETag
+			w.Header().Set("ETag", strings.TrimSuffix(etag, `"`)+"-"+enc.encoding+`"`)
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		http.ServeContent(w, r, name, st.ModTime(), content)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,159 @@
+package nf
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"gotest.tools/v3/assert"
+)
+
+func TestCompress(t *testing.T) {
+	big := strings.Repeat(`{"name":"pipe"},`, 200)
+	router := httprouter.New()
+	config := &CompressionConfig{MinSize: 100}
+	Handle(router, "GET", "/compress/big", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) { SendText(w, big) }, Compress(config))
+	Handle(router, "GET", "/compress/small", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) { SendText(w, "small") }, Compress(config))
+	Handle(router, "GET", "/compress/png", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte(big))
+	}, Compress(config))
+
+	get := func(path, accept string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Accept-Encoding", accept)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("/compress/big", "gzip, deflate")
+	assert.Equal(t, w.Header().Get("Content-Encoding"), "gzip")
+	assert.Equal(t, w.Header().Get("Vary"), "Accept-Encoding")
+	zr, err := gzip.NewReader(w.Body)
+	assert.NilError(t, err)
+	raw, err := io.ReadAll(zr)
+	assert.NilError(t, err)
+	assert.Equal(t, string(raw), big)
+
+	assert.Equal(t, get("/compress/big", "gzip;q=0").Header().Get("Content-Encoding"), "")
+	assert.Equal(t, get("/compress/small", "gzip").Header().Get("Content-Encoding"), "")
+	assert.Equal(t, get("/compress/small", "gzip").Body.String(), "small")
+	assert.Equal(t, get("/compress/png", "gzip").Header().Get("Content-Encoding"), "")
+}
+
+func TestCompressRange(t *testing.T) {
+	content := strings.Repeat("0123456789", 500)
+	router := httprouter.New()
+	config := &CompressionConfig{MinSize: 100}
+	Handle(router, "GET", "/compress/report.txt", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		SendReader(w, r, strings.NewReader(content), "report.txt", time.Time{}, false)
+	}, Compress(config))
+	Handle(router, "GET", "/compress/twice", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		w.WriteHeader(http.StatusCreated)
+		w.WriteHeader(http.StatusInternalServerError)
+		SendText(w, content)
+	}, Compress(config))
+
+	r := httptest.NewRequest("GET", "/compress/report.txt", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	r.Header.Set("Range", "bytes=100-2099")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	assert.Equal(t, w.Code, http.StatusPartialContent)
+	assert.Equal(t, w.Header().Get("Content-Encoding"), "")
+	assert.Equal(t, w.Header().Get("Content-Range"), "bytes 100-2099/5000")
+	assert.Equal(t, w.Body.String(), content[100:2100])
+
+	// Without a Range, the whole file is compressed as usual
+	r.Header.Del("Range")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Equal(t, w.Header().Get("Content-Encoding"), "gzip")
+
+	// A second WriteHeader is ignored
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/compress/twice", nil))
+	assert.Equal(t, w.Code, http.StatusCreated)
+	r = httptest.NewRequest("GET", "/compress/twice", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	assert.Equal(t, w.Code, http.StatusCreated)
+	assert.Equal(t, w.Header().Get("Content-Encoding"), "gzip")
+}
+
+func TestPrecompressed(t *testing.T) {
+	fsys := fstest.MapFS{
+		"main.js":    {Data: []byte("plain")},
+		"main.js.gz": {Data: []byte("gzipped")},
+		"main.js.br": {Data: []byte("brotli")},
+	}
+	serve := func(accept string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/static/main.js", nil)
+		r.Header.Set("Accept-Encoding", accept)
+		w := httptest.NewRecorder()
+		if !servePrecompressed(w, r, fsys, "/main.js") {
+			w.WriteString("plain")
+		}
+		return w
+	}
+	w := serve("gzip, br")
+	assert.Equal(t, w.Body.String(), "brotli")
+	assert.Equal(t, w.Header().Get("Content-Encoding"), "br")
+	assert.Equal(t, w.Header().Get("Content-Type"), "text/javascript; charset=utf-8")
+	assert.Equal(t, serve("gzip").Body.String(), "gzipped")
+	assert.Equal(t, serve("identity").Body.String(), "plain")
+}
+
+func TestCompressedRequestBody(t *testing.T) {
+	router := httprouter.New()
+	Handle(router, "POST", "/upload", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		var obj map[string]string
+		ReadJSON(r, &obj)
+		SendText(w, obj["name"])
+	})
+
+	post := func(encoding string, body []byte) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/upload", bytes.NewReader(body))
+		r.Header.Set("Content-Encoding", encoding)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	gzipped := func(s string) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write([]byte(s))
+		zw.Close()
+		return buf.Bytes()
+	}
+
+	w := post("gzip", gzipped(`{"name":"pipe"}`))
+	assert.Equal(t, w.Code, 200)
+	assert.Equal(t, w.Body.String(), "pipe")
+
+	var zbuf bytes.Buffer
+	zw := zlib.NewWriter(&zbuf)
+	zw.Write([]byte(`{"name":"valve"}`))
+	zw.Close()
+	assert.Equal(t, post("deflate", zbuf.Bytes()).Body.String(), "valve")
+
+	assert.Equal(t, post("br", []byte("x")).Code, http.StatusUnsupportedMediaType)
+	assert.Equal(t, post("gzip", []byte("not gzip")).Code, http.StatusBadRequest)
+
+	orgMax := MaxDecompressedBodySize
+	MaxDecompressedBodySize = 1000
+	defer func() { MaxDecompressedBodySize = orgMax }()
+	bomb := `{"name":"` + strings.Repeat("a", 2000) + `"}`
+	assert.Equal(t, post("gzip", gzipped(bomb)).Code, http.StatusRequestEntityTooLarge)
+}
@@ -0,0 +1,217 @@
+package nf
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// CORSPolicy describes which cross-origin requests a route accepts.
+// See https://developer.mozilla.org/en-US/docs/Web/HTTP/CORS
+type CORSPolicy struct {
+	// AllowedOrigins are origins such as "https://maps.imqs.co.za". An origin may contain one '*' wildcard,
+	// such as "https://*.imqs.co.za", which matches a single host label (so not "https://evil.com.imqs.co.za").
+	// "*" allows any origin, but it cannot be combined with AllowCredentials.
+	AllowedOrigins []string
+	// AllowedMethods are the methods that are allowed in a preflight request. If empty, then only the method
+	// of the route is allowed.
+	AllowedMethods []string
+	// AllowedHeaders are the request headers that a client may send. If empty, then DefaultCORSHeaders is used.
+	// "*" allows any header.
+	AllowedHeaders []string
+	// ExposedHeaders are the response headers that the browser will expose to the calling script.
+	ExposedHeaders []string
+	// AllowCredentials allows the browser to send cookies, such as the IMQS session cookie.
+	// This is refused (with a panic when the route is registered) if AllowedOrigins contains "*", because that
+	// would allow any website to make requests on behalf of the user.
+	AllowCredentials bool
+	// MaxAge is how long the browser may cache the result of a preflight request.
+	MaxAge time.Duration
+}
+
+// DefaultCORSHeaders are the request headers that are allowed when CORSPolicy.AllowedHeaders is empty.
+var DefaultCORSHeaders = []string{"Accept", "Authorization", "Content-Type", "X-Requested-With"}
+
+// DefaultCORS is the policy of every route registered through nf, unless the route has its own CORS option.
+// If nil (the default), then cross-origin requests are not allowed.
+// Like BypassAuth, this must be set before your routes are registered.
+var DefaultCORS *CORSPolicy
+
+// CORS sets the CORS policy of a route, overriding DefaultCORS. Pass nil to disallow cross-origin requests to the route.
+// nf answers preflight OPTIONS requests for every path that has a CORS policy, so you must not register
+// your own OPTIONS handler on such a path.
+func CORS(policy *CORSPolicy) RouteOption {
+	return func(r *Route) {
+		r.CORS = policy
+		r.corsSet = true
+	}
+}
+
+// AllowsOrigin returns true if origin matches one of the policy's AllowedOrigins.
+func (c *CORSPolicy) AllowsOrigin(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+		if matchOriginLabel(strings.ToLower(allowed), strings.ToLower(origin)) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchOriginLabel matches an origin against a pattern such as "https://*.imqs.co.za", where '*' stands for
+// exactly one host label, so it cannot match a '.', ':' or '/'.
+func matchOriginLabel(pattern, origin string) bool {
+	prefix, suffix, ok := strings.Cut(pattern, "*")
+	if !ok || !strings.HasPrefix(origin, prefix) || !strings.HasSuffix(origin, suffix) || len(origin) <= len(prefix)+len(suffix) {
+		return false
+	}
+	label := origin[len(prefix) : len(origin)-len(suffix)]
+	return !strings.ContainsAny(label, ".:/")
+}
+
+// validate panics if the policy is unsafe or malformed. This is called when a route is registered.
+func (c *CORSPolicy) validate() {
+	for _, o := range c.AllowedOrigins {
+		if o != "*" && strings.Count(o, "*") > 1 {
+			panic(fmt.Sprintf("CORS origin %v may contain only one '*'", o))
+		}
+	}
+	if c.isWildcard() && c.AllowCredentials {
+		panic("CORS policy may not combine the origin \"*\" with AllowCredentials")
+	}
+}
+
+func (c *CORSPolicy) allowsHeaders(requested []string) bool {
+	allowed := c.AllowedHeaders
+	if len(allowed) == 0 {
+		allowed = DefaultCORSHeaders
+	}
+	for _, h := range requested {
+		found := false
+		for _, a := range allowed {
+			if a == "*" || strings.EqualFold(a, h) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *CORSPolicy) setOrigin(w http.ResponseWriter, origin string) {
+	if c.isWildcard() {
+		// Never with credentials, even if the policy was changed after validate
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+	// The browser will not send cookies to "*", so we need to echo the origin
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if c.AllowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+func (c *CORSPolicy) isWildcard() bool {
+	for _, o := range c.AllowedOrigins {
+		if o == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// setHeaders adds the CORS headers to the response of an actual (ie not preflight) request
+func (c *CORSPolicy) setHeaders(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Vary", "Origin")
+	origin := r.Header.Get("Origin")
+	if !c.AllowsOrigin(origin) {
+		return
+	}
+	c.setOrigin(w, origin)
+	if len(c.ExposedHeaders) != 0 {
+		w.Header().Set("Access-Control-Expose-Headers", strings.Join(c.ExposedHeaders, ", "))
+	}
+}
+
+// preflight answers the OPTIONS requests for a single path, which may have several methods, each with their own policy
+type preflight struct {
+	lock     sync.Mutex
+	policies map[string]*CORSPolicy // key is the HTTP method
+}
+
+var preflightLock sync.Mutex
+var preflights = map[*httprouter.Router]map[string]*preflight{}
+
+// addPreflight ensures that the path of route has an OPTIONS handler, which knows about route's CORS policy
+func addPreflight(router *httprouter.Router, route *Route) {
+	preflightLock.Lock()
+	defer preflightLock.Unlock()
+	paths := preflights[router]
+	if paths == nil {
+		paths = map[string]*preflight{}
+		preflights[router] = paths
+	}
+	pf := paths[route.Path]
+	if pf == nil {
+		pf = &preflight{policies: map[string]*CORSPolicy{}}
+		paths[route.Path] = pf
+		router.Handle("OPTIONS", route.Path, pf.serve)
+	}
+	pf.lock.Lock()
+	pf.policies[route.Method] = route.CORS
+	pf.lock.Unlock()
+}
+
+func (pf *preflight) serve(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	pf.lock.Lock()
+	methods := []string{"OPTIONS"}
+	for m := range pf.policies {
+		methods = append(methods, m)
+	}
+	policy := pf.policies[r.Header.Get("Access-Control-Request-Method")]
+	pf.lock.Unlock()
+
+	sort.Strings(methods)
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	w.Header().Add("Vary", "Origin")
+	w.Header().Add("Vary", "Access-Control-Request-Method")
+	w.Header().Add("Vary", "Access-Control-Request-Headers")
+
+	// If the request is not allowed, then we respond without any CORS headers, and the browser will block the actual request
+	origin := r.Header.Get("Origin")
+	var requestHeaders []string
+	for _, h := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			requestHeaders = append(requestHeaders, h)
+		}
+	}
+	if policy != nil && policy.AllowsOrigin(origin) && policy.allowsHeaders(requestHeaders) {
+		policy.setOrigin(w, origin)
+		allowMethods := policy.AllowedMethods
+		if len(allowMethods) == 0 {
+			allowMethods = []string{r.Header.Get("Access-Control-Request-Method")}
+		}
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(allowMethods, ", "))
+		if len(requestHeaders) != 0 {
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(requestHeaders, ", "))
+		}
+		if policy.MaxAge != 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(policy.MaxAge.Seconds())))
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
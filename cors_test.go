@@ -0,0 +1,107 @@
+package nf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"gotest.tools/v3/assert"
+)
+
+func TestCORS(t *testing.T) {
+	policy := &CORSPolicy{
+		AllowedOrigins:   []string{"https://*.imqs.co.za", "http://localhost:8080"},
+		AllowCredentials: true,
+		ExposedHeaders:   []string{"X-Total"},
+		MaxAge:           time.Hour,
+	}
+	router := httprouter.New()
+	ok := func(w http.ResponseWriter, r *http.Request, p httprouter.Params) { SendOK(w) }
+	Handle(router, "GET", "/cors/:id", ok, CORS(policy))
+	Handle(router, "PUT", "/cors/:id", ok, CORS(policy))
+	Handle(router, "GET", "/nocors", ok)
+
+	request := func(method, path, origin string, headers map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	// Preflight
+	w := request("OPTIONS", "/cors/1", "https://maps.imqs.co.za", map[string]string{"Access-Control-Request-Method": "PUT", "Access-Control-Request-Headers": "content-type"})
+	assert.Equal(t, w.Code, 204)
+	assert.Equal(t, w.Header().Get("Access-Control-Allow-Origin"), "https://maps.imqs.co.za")
+	assert.Equal(t, w.Header().Get("Access-Control-Allow-Methods"), "PUT")
+	assert.Equal(t, w.Header().Get("Access-Control-Allow-Headers"), "content-type")
+	assert.Equal(t, w.Header().Get("Access-Control-Allow-Credentials"), "true")
+	assert.Equal(t, w.Header().Get("Access-Control-Max-Age"), "3600")
+	assert.Equal(t, w.Header().Get("Allow"), "GET, OPTIONS, PUT")
+
+	// Preflight from a foreign origin, or with a disallowed header, or for an unknown method
+	for _, bad := range []*httptest.ResponseRecorder{
+		request("OPTIONS", "/cors/1", "https://evil.com", map[string]string{"Access-Control-Request-Method": "PUT"}),
+		request("OPTIONS", "/cors/1", "https://evil.com/.imqs.co.za", map[string]string{"Access-Control-Request-Method": "PUT"}),
+		request("OPTIONS", "/cors/1", "https://evil.com.imqs.co.za", map[string]string{"Access-Control-Request-Method": "PUT"}),
+		request("OPTIONS", "/cors/1", "https://evil.com:1.imqs.co.za", map[string]string{"Access-Control-Request-Method": "PUT"}),
+		request("OPTIONS", "/cors/1", "https://.imqs.co.za", map[string]string{"Access-Control-Request-Method": "PUT"}),
+		request("OPTIONS", "/cors/1", "http://localhost:8080", map[string]string{"Access-Control-Request-Method": "PUT", "Access-Control-Request-Headers": "X-Secret"}),
+		request("OPTIONS", "/cors/1", "http://localhost:8080", map[string]string{"Access-Control-Request-Method": "DELETE"}),
+	} {
+		assert.Equal(t, bad.Code, 204)
+		assert.Equal(t, bad.Header().Get("Access-Control-Allow-Origin"), "")
+	}
+
+	// Actual requests
+	w = request("GET", "/cors/1", "http://localhost:8080", nil)
+	assert.Equal(t, w.Code, 200)
+	assert.Equal(t, w.Header().Get("Access-Control-Allow-Origin"), "http://localhost:8080")
+	assert.Equal(t, w.Header().Get("Access-Control-Expose-Headers"), "X-Total")
+	w = request("GET", "/nocors", "http://localhost:8080", nil)
+	assert.Equal(t, w.Header().Get("Access-Control-Allow-Origin"), "")
+}
+
+func TestCORSWildcard(t *testing.T) {
+	router := httprouter.New()
+	ok := func(w http.ResponseWriter, r *http.Request, p httprouter.Params) { SendOK(w) }
+
+	// Any origin with credentials would let every website act on behalf of the user
+	err := func() (rec interface{}) {
+		defer func() { rec = recover() }()
+		Handle(router, "GET", "/cors-wildcard/credentials", ok, CORS(&CORSPolicy{AllowedOrigins: []string{"*"}, AllowCredentials: true}))
+		return nil
+	}()
+	assert.Equal(t, err, `CORS policy may not combine the origin "*" with AllowCredentials`)
+
+	policy := &CORSPolicy{AllowedOrigins: []string{"*"}}
+	Handle(router, "GET", "/cors-wildcard/public", ok, CORS(policy))
+	r := httptest.NewRequest("GET", "/cors-wildcard/public", nil)
+	r.Header.Set("Origin", "https://evil.com")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	assert.Equal(t, w.Header().Get("Access-Control-Allow-Origin"), "*")
+	assert.Equal(t, w.Header().Get("Access-Control-Allow-Credentials"), "")
+
+	// Even if the policy is changed after registration, we never send credentials to "*"
+	policy.AllowCredentials = true
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	assert.Equal(t, w.Header().Get("Access-Control-Allow-Origin"), "*")
+	assert.Equal(t, w.Header().Get("Access-Control-Allow-Credentials"), "")
+
+	// A wildcard matches exactly one host label
+	label := &CORSPolicy{AllowedOrigins: []string{"https://*.imqs.co.za"}}
+	assert.Assert(t, label.AllowsOrigin("https://maps.imqs.co.za"))
+	assert.Assert(t, label.AllowsOrigin("HTTPS://Maps.IMQS.co.za"))
+	assert.Assert(t, !label.AllowsOrigin("https://evil.com.imqs.co.za"))
+	assert.Assert(t, !label.AllowsOrigin("https://imqs.co.za"))
+	assert.Assert(t, !label.AllowsOrigin("http://maps.imqs.co.za"))
+}
@@ -0,0 +1,109 @@
+package nf
+
+import (
+	"bufio"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// SendFile sends the file at filename, with support for Range, If-Range and If-Modified-Since requests.
+// The content type is determined from the file extension, or by sniffing the content.
+// If attachment is true, then the browser is told to download the file (with its base name) instead of displaying it.
+// Panics with 404 if the file does not exist.
+func SendFile(w http.ResponseWriter, r *http.Request, filename string, attachment bool) {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		PanicNotFound()
+	}
+	Check(err)
+	defer f.Close()
+	st, err := f.Stat()
+	Check(err)
+	if st.IsDir() {
+		PanicNotFound()
+	}
+	SendReader(w, r, f, filepath.Base(filename), st.ModTime(), attachment)
+}
+
+// SendReader sends content, which may be a file, a blob that was read from the database, or a database large object
+// (see nfdb.OpenLargeObject).
+// name is used to determine the content type (from its extension), and is the file name of an attachment. It may be empty,
+// in which case the content type is sniffed from the first 512 bytes of content.
+// modTime may be zero, if it is unknown.
+// If content is an io.ReadSeeker, then Range and If-Range requests are supported, so that large downloads can be resumed.
+// For If-Range to work with an ETag, set the ETag header before calling SendReader.
+// If attachment is true, then the browser is told to download the content instead of displaying it.
+func SendReader(w http.ResponseWriter, r *http.Request, content io.Reader, name string, modTime time.Time, attachment bool) {
+	if attachment {
+		w.Header().Set("Content-Disposition", ContentDisposition("attachment", name))
+	}
+	if seeker, ok := content.(io.ReadSeeker); ok {
+		// ServeContent does the content type detection, ranges, and conditional requests
+		http.ServeContent(w, r, name, modTime, seeker)
+		return
+	}
+
+	// We can't seek, so we can't support ranges
+	w.Header().Set("Accept-Ranges", "none")
+	buffered := bufio.NewReader(content)
+	if w.Header().Get("Content-Type") == "" {
+		ctype := mime.TypeByExtension(filepath.Ext(name))
+		if ctype == "" {
+			start, _ := buffered.Peek(512)
+			ctype = http.DetectContentType(start)
+		}
+		w.Header().Set("Content-Type", ctype)
+	}
+	if !modTime.IsZero() {
+		w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+		if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modTime.Truncate(time.Second).After(since) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	if r.Method == "HEAD" {
+		return
+	}
+	io.Copy(w, buffered)
+}
+
+// ContentDisposition returns a Content-Disposition header value, such as `attachment; filename="report.pdf"`.
+// Names that are not plain ASCII are encoded according to RFC 6266, with an ASCII fallback for old clients.
+func ContentDisposition(disposition, filename string) string {
+	if filename == "" {
+		return disposition
+	}
+	fallback := strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' || r == '/' {
+			return '_'
+		}
+		return r
+	}, filename)
+	value := disposition + `; filename="` + fallback + `"`
+	if fallback != filename {
+		value += "; filename*=UTF-8''" + encodeRFC5987(filename)
+	}
+	return value
+}
+
+// encodeRFC5987 percent-encodes every byte of s that is not an attr-char of RFC 5987
+func encodeRFC5987(s string) string {
+	const hex = "0123456789ABCDEF"
+	b := strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("!#$&+-.^_`|~", c) != -1 {
+			b.WriteByte(c)
+		} else {
+			b.WriteByte('%')
+			b.WriteByte(hex[c>>4])
+			b.WriteByte(hex[c&15])
+		}
+	}
+	return b.String()
+}
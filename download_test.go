@@ -0,0 +1,58 @@
+package nf
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestSendReader(t *testing.T) {
+	modTime := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	send := func(header, value string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/download", nil)
+		if header != "" {
+			r.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		SendReader(w, r, bytes.NewReader([]byte("0123456789")), "Résumé 2024.pdf", modTime, true)
+		return w
+	}
+
+	w := send("", "")
+	assert.Equal(t, w.Code, 200)
+	assert.Equal(t, w.Header().Get("Content-Type"), "application/pdf")
+	assert.Equal(t, w.Header().Get("Content-Disposition"), `attachment; filename="R_sum_ 2024.pdf"; filename*=UTF-8''R%C3%A9sum%C3%A9%202024.pdf`)
+
+	w = send("Range", "bytes=2-4")
+	assert.Equal(t, w.Code, http.StatusPartialContent)
+	assert.Equal(t, w.Body.String(), "234")
+
+	// If-Range with an old date must send the whole file
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/download", nil)
+	r.Header.Set("Range", "bytes=2-4")
+	r.Header.Set("If-Range", modTime.Add(-time.Hour).Format(http.TimeFormat))
+	SendReader(w, r, bytes.NewReader([]byte("0123456789")), "a.bin", modTime, false)
+	assert.Equal(t, w.Code, 200)
+	assert.Equal(t, w.Body.String(), "0123456789")
+
+	// Not seekable, so no ranges, and the content type is sniffed
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/download", nil)
+	r.Header.Set("Range", "bytes=2-4")
+	SendReader(w, r, io.MultiReader(strings.NewReader("<html><body>hi</body></html>")), "", time.Time{}, false)
+	assert.Equal(t, w.Code, 200)
+	assert.Equal(t, w.Header().Get("Accept-Ranges"), "none")
+	assert.Equal(t, w.Header().Get("Content-Type"), "text/html; charset=utf-8")
+	assert.Equal(t, w.Header().Get("Content-Disposition"), "")
+
+	assert.Equal(t, ContentDisposition("attachment", "plain.csv"), `attachment; filename="plain.csv"`)
+	assert.Equal(t, ContentDisposition("attachment", "rapport é=(1)*:@'x.pdf"),
+		`attachment; filename="rapport _=(1)*:@'x.pdf"; filename*=UTF-8''rapport%20%C3%A9%3D%281%29%2A%3A%40%27x.pdf`)
+}
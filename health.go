@@ -0,0 +1,244 @@
+package nf
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// HealthCheckKind determines which health endpoint a check participates in.
+type HealthCheckKind int
+
+const (
+	// HealthReadiness checks determine whether the service should receive traffic (eg the DB is reachable).
+	// A failing readiness check does not mean that the process needs to be restarted.
+	HealthReadiness HealthCheckKind = iota
+	// HealthLiveness checks determine whether the process is alive at all. A failing liveness check
+	// will usually cause the orchestrator to restart the service. Liveness checks are also part of readiness.
+	HealthLiveness
+)
+
+// DefaultHealthCheckTimeout is used when HealthCheck.Timeout is zero.
+var DefaultHealthCheckTimeout = 5 * time.Second
+
+// DefaultHealth is the registry that is served by HandleHealth.
+var DefaultHealth = NewHealth()
+
+// HealthCheck is a single named check, which is registered with Health.Add.
+type HealthCheck struct {
+	Name     string
+	Kind     HealthCheckKind
+	Check    func(ctx context.Context) error // Return nil if healthy
+	Timeout  time.Duration                   // If zero, then DefaultHealthCheckTimeout
+	CacheFor time.Duration                   // If non-zero, then results are reused for this long, to protect expensive checks from aggressive probing
+}
+
+// HealthCheckResult is the outcome of a single check.
+type HealthCheckResult struct {
+	Name     string
+	Status   string  // "ok" or "fail"
+	Error    string  `json:",omitempty"`
+	Duration float64 // Seconds
+	Cached   bool
+}
+
+// HealthReport is the JSON object sent by the health endpoints.
+type HealthReport struct {
+	Status    string // "ok" or "fail"
+	Timestamp int64
+	Checks    []HealthCheckResult
+}
+
+// Health is a registry of health checks.
+type Health struct {
+	lock   sync.Mutex
+	checks []*healthCheckState
+}
+
+type healthCheckState struct {
+	HealthCheck
+	lock    sync.Mutex // Held while the check is running, so that concurrent probes don't pile up
+	last    HealthCheckResult
+	lastRun time.Time
+}
+
+var healthStatus = DefaultMetrics.NewGauge("nf_health_check_status", "Result of the most recent run of a health check (1 = ok, 0 = fail).", "check")
+
+// NewHealth creates a new, empty health registry.
+func NewHealth() *Health {
+	return &Health{}
+}
+
+// Add registers a check. If a check with the same name already exists, then it is replaced.
+func (h *Health) Add(check HealthCheck) {
+	if check.Name == "" || check.Check == nil {
+		panic("HealthCheck must have a Name and a Check function")
+	}
+	if check.Timeout == 0 {
+		check.Timeout = DefaultHealthCheckTimeout
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for i, c := range h.checks {
+		if c.Name == check.Name {
+			h.checks[i] = &healthCheckState{HealthCheck: check}
+			return
+		}
+	}
+	h.checks = append(h.checks, &healthCheckState{HealthCheck: check})
+}
+
+// Remove unregisters the check with the given name.
+func (h *Health) Remove(name string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for i, c := range h.checks {
+		if c.Name == name {
+			h.checks = append(h.checks[:i], h.checks[i+1:]...)
+			return
+		}
+	}
+}
+
+// Run runs all the checks of the given kind concurrently, and returns the combined report.
+// HealthReadiness runs all checks, and HealthLiveness runs only the liveness checks.
+func (h *Health) Run(ctx context.Context, kind HealthCheckKind) HealthReport {
+	h.lock.Lock()
+	checks := []*healthCheckState{}
+	for _, c := range h.checks {
+		if kind == HealthReadiness || c.Kind == HealthLiveness {
+			checks = append(checks, c)
+		}
+	}
+	h.lock.Unlock()
+
+	report := HealthReport{
+		Status:    "ok",
+		Timestamp: time.Now().Unix(),
+		Checks:    make([]HealthCheckResult, len(checks)),
+	}
+	wg := sync.WaitGroup{}
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c *healthCheckState) {
+			defer wg.Done()
+			report.Checks[i] = c.run(ctx)
+		}(i, c)
+	}
+	wg.Wait()
+
+	sort.Slice(report.Checks, func(i, j int) bool { return report.Checks[i].Name < report.Checks[j].Name })
+	for _, c := range report.Checks {
+		if c.Status != "ok" {
+			report.Status = "fail"
+		}
+	}
+	return report
+}
+
+// SendReport sends the report for the given kind of check, with a 200 status code if all checks pass, or 503 if any check fails.
+func (h *Health) SendReport(w http.ResponseWriter, r *http.Request, kind HealthCheckKind) {
+	report := h.Run(r.Context(), kind)
+	b, err := json.Marshal(report)
+	Check(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "max-age=0, no-cache")
+	if report.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(b)
+}
+
+// HandleHealth serves the liveness and readiness reports of DefaultHealth, typically at "/health/live" and "/health/ready".
+// Either path may be empty, in which case that endpoint is not registered.
+// These endpoints are intended to be polled by container orchestrators and the IMQS router, so they are not authenticated.
+func HandleHealth(router *httprouter.Router, livePath, readyPath string) {
+	if livePath != "" {
+		router.Handle("GET", livePath, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+			DefaultHealth.SendReport(w, r, HealthLiveness)
+		})
+	}
+	if readyPath != "" {
+		router.Handle("GET", readyPath, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+			DefaultHealth.SendReport(w, r, HealthReadiness)
+		})
+	}
+}
+
+func (c *healthCheckState) run(ctx context.Context) HealthCheckResult {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.CacheFor != 0 && !c.lastRun.IsZero() && time.Since(c.lastRun) < c.CacheFor {
+		cached := c.last
+		cached.Cached = true
+		return cached
+	}
+
+	start := time.Now()
+	_, err := callWithTimeout(ctx, c.Timeout, c.Check)
+
+	res := HealthCheckResult{
+		Name:     c.Name,
+		Status:   "ok",
+		Duration: time.Since(start).Seconds(),
+	}
+	if err != nil {
+		res.Status = "fail"
+		res.Error = err.Error()
+		healthStatus.Set(0, c.Name)
+	} else {
+		healthStatus.Set(1, c.Name)
+	}
+	c.last = res
+	c.lastRun = time.Now()
+	return res
+}
+
+// HealthCheckDB returns a check function that pings the database.
+// If you're using GORM, then pass in gormDB.DB().
+func HealthCheckDB(db *sql.DB) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		return db.PingContext(ctx)
+	}
+}
+
+// HealthCheckURL returns a check function that succeeds if a GET request to url returns a status code below 400.
+// This is intended for checking that a dependent service (eg the auth service) is reachable.
+func HealthCheckURL(url string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("%v returned %v", url, resp.Status)
+		}
+		return nil
+	}
+}
+
+// HealthCheckDiskSpace returns a check function that fails if the volume holding path has less than minFreeBytes available.
+func HealthCheckDiskSpace(path string, minFreeBytes uint64) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		free, err := diskFreeBytes(path)
+		if err != nil {
+			return err
+		}
+		if free < minFreeBytes {
+			return fmt.Errorf("Only %v MB free on %v, but need at least %v MB", free/(1024*1024), path, minFreeBytes/(1024*1024))
+		}
+		return nil
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+// +build !windows
+
+package nf
+
+import "syscall"
+
+func diskFreeBytes(path string) (uint64, error) {
+	st := syscall.Statfs_t{}
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
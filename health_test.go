@@ -0,0 +1,44 @@
+package nf
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestHealth(t *testing.T) {
+	h := NewHealth()
+	calls := 0
+	h.Add(HealthCheck{Name: "live", Kind: HealthLiveness, Check: func(ctx context.Context) error { return nil }})
+	h.Add(HealthCheck{Name: "db", Check: func(ctx context.Context) error { calls++; return errors.New("db down") }, CacheFor: time.Hour})
+	h.Add(HealthCheck{Name: "slow", Timeout: 10 * time.Millisecond, Check: func(ctx context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	}})
+
+	live := h.Run(context.Background(), HealthLiveness)
+	assert.Equal(t, live.Status, "ok")
+	assert.Equal(t, len(live.Checks), 1)
+
+	rec := httptest.NewRecorder()
+	h.SendReport(rec, httptest.NewRequest("GET", "/health/ready", nil), HealthReadiness)
+	assert.Equal(t, rec.Code, 503)
+	report := HealthReport{}
+	assert.NilError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+	assert.Equal(t, report.Status, "fail")
+	assert.Equal(t, len(report.Checks), 3)
+	assert.Equal(t, report.Checks[0].Name, "db")
+	assert.Equal(t, report.Checks[0].Error, "db down")
+	assert.Equal(t, report.Checks[2].Name, "slow")
+	assert.Equal(t, report.Checks[2].Status, "fail")
+
+	// The failing DB check must be served from cache
+	again := h.Run(context.Background(), HealthReadiness)
+	assert.Equal(t, again.Checks[0].Cached, true)
+	assert.Equal(t, calls, 1)
+}
@@ -2,6 +2,7 @@ package nf
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -17,15 +18,36 @@ import (
 // `Handle` function. The value of the auth token becomes `nil`.
 var BypassAuth bool = false
 
+// AuthBreaker, if not nil, protects the calls that HandleAuthenticated makes to the auth service. While the auth
+// service is failing (responding with 5xx), authenticated routes fail fast with 503, instead of waiting on it.
+// Like BypassAuth, this must be set before your routes are registered.
+var AuthBreaker *CircuitBreaker
+
+// AuthBulkhead, if not nil, limits the number of concurrent calls that HandleAuthenticated makes to the auth service.
+// Requests that find it full receive 503. Like BypassAuth, this must be set before your routes are registered.
+var AuthBulkhead *Bulkhead
+
 // AuthenticatedHandler is an HTTP handler function that has already had authentication information read from the auth service.
 type AuthenticatedHandler func(w http.ResponseWriter, r *http.Request, p httprouter.Params, auth *serviceauth.Token)
 
 // RunProtected runs 'func' inside a panic handler that recognizes our special errors,
 // and sends the appropriate HTTP response if a panic does occur.
 func RunProtected(w http.ResponseWriter, handler func()) {
+	runProtected(w, nil, handler)
+}
+
+// runProtected is RunProtected, but it also returns the recovered panic (or nil, if there was no panic).
+// If r is not nil, and its context is done, then a panic is assumed to be the result of the
+// cancellation (eg a DB query that was aborted), and we respond accordingly, unless the handler has
+// already started its response.
+func runProtected(w http.ResponseWriter, r *http.Request, handler func()) (rec interface{}) {
 	defer func() {
-		if rec := recover(); rec != nil {
-			if hErr, ok := rec.(HTTPError); ok {
+		if rec = recover(); rec != nil {
+			if r != nil && r.Context().Err() != nil {
+				if !responseStarted(w) {
+					sendContextError(w, r.Context().Err())
+				}
+			} else if hErr, ok := rec.(HTTPError); ok {
 				http.Error(w, hErr.Message, hErr.Code)
 			} else if err, ok := rec.(error); ok {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -38,14 +60,16 @@ func RunProtected(w http.ResponseWriter, handler func()) {
 	}()
 
 	handler()
+	return nil
 }
 
 // Handle adds a protected HTTP route to router (ie handle will run inside RunProtected, so you get a panic handler).
-func Handle(router *httprouter.Router, method, path string, handle httprouter.Handle) {
-	wrapper := func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-		RunProtected(w, func() { handle(w, r, p) })
-	}
-	router.Handle(method, path, wrapper)
+// opts are optional, and describe the route for documentation (see Routes and HandleOpenAPI), or change its behaviour (eg CORS).
+func Handle(router *httprouter.Router, method, path string, handle httprouter.Handle, opts ...RouteOption) {
+	route := newRoute(method, path, false, nil, opts)
+	addRoute(router, route, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) interface{} {
+		return route.serve(w, r, nil, func(w http.ResponseWriter) { handle(w, r, p) })
+	})
 }
 
 // HandleAuthenticated adds a protected HTTP route to router (ie handle will run inside RunProtected, so you get a panic handler).
@@ -53,27 +77,58 @@ func Handle(router *httprouter.Router, method, path string, handle httprouter.Ha
 // will not call your 'handle' function, but will return with 403 Forbidden.
 // In addition, the authentication token must have the 'enabled' permission set, otherwise a 403 Forbidden is returned, with
 // the response body "User Disabled".
-func HandleAuthenticated(router *httprouter.Router, method, path string, handle AuthenticatedHandler, needPermissions []int) {
-	var wrapper func(w http.ResponseWriter, r *http.Request, p httprouter.Params)
+// opts are optional, and describe the route for documentation (see Routes and HandleOpenAPI), or change its behaviour (eg CORS).
+func HandleAuthenticated(router *httprouter.Router, method, path string, handle AuthenticatedHandler, needPermissions []int, opts ...RouteOption) {
+	route := newRoute(method, path, true, needPermissions, opts)
 	if BypassAuth {
-		wrapper = func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-			RunProtected(w, func() { handle(w, r, p, nil) })
+		addRoute(router, route, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) interface{} {
+			return route.serve(w, r, nil, func(w http.ResponseWriter) { handle(w, r, p, nil) })
+		})
+		return
+	}
+	breaker, bulkhead := AuthBreaker, AuthBulkhead
+	addRoute(router, route, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) interface{} {
+		authCode, authMsg, authToken := getToken(r, breaker, bulkhead)
+		if authCode != http.StatusOK {
+			http.Error(w, authMsg, authCode)
+			return nil
 		}
-	} else {
-		wrapper = func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-			authCode, authMsg, authToken := serviceauth.GetToken(r)
-			if authCode != http.StatusOK {
-				http.Error(w, authMsg, authCode)
-				return
-			}
-			if !(authToken.IsInterService || authToken.HasPermByID(permissions.PermEnabled)) {
-				http.Error(w, "User Disabled", http.StatusForbidden)
-				return
-			}
-			RunProtected(w, func() { handle(w, r, p, authToken) })
+		if !(authToken.IsInterService || authToken.HasPermByID(permissions.PermEnabled)) {
+			http.Error(w, "User Disabled", http.StatusForbidden)
+			return nil
+		}
+		r, cancel := withCallerTimeout(r, authToken)
+		defer cancel()
+		return route.serve(w, r, authToken, func(w http.ResponseWriter) { handle(w, r, p, authToken) })
+	})
+}
+
+// getToken is a variable so that tests can authenticate requests without the auth service
+var getToken = getAuthServiceToken
+
+// getAuthServiceToken is serviceauth.GetToken, inside the given circuit breaker and bulkhead (either of which may be nil)
+func getAuthServiceToken(r *http.Request, breaker *CircuitBreaker, bulkhead *Bulkhead) (int, string, *serviceauth.Token) {
+	if bulkhead != nil {
+		release, err := bulkhead.Acquire(r.Context())
+		if err != nil {
+			return http.StatusServiceUnavailable, err.Error(), nil
+		}
+		defer release()
+	}
+	if breaker != nil {
+		if err := breaker.Allow(); err != nil {
+			return http.StatusServiceUnavailable, err.Error(), nil
 		}
 	}
-	router.Handle(method, path, wrapper)
+	code, msg, token := serviceauth.GetToken(r)
+	if breaker != nil {
+		if code >= 500 {
+			breaker.Failure()
+		} else {
+			breaker.Success()
+		}
+	}
+	return code, msg, token
 }
 
 // ParseID parses a 64-bit integer, and returns zero on failure.
@@ -83,14 +138,23 @@ func ParseID(s string) int64 {
 }
 
 // ReadJSON reads the body of the request, and unmarshals it into 'obj'.
+// A gzip or deflate encoded body is decompressed (see DecodeRequestBody).
 func ReadJSON(r *http.Request, obj interface{}) {
 	if r.Body == nil {
 		Panic(http.StatusBadRequest, "ReadJSON failed: Request body is empty")
 	}
+	if err := DecodeRequestBody(r); err != nil {
+		if errors.Is(err, errUnsupportedEncoding) {
+			Panic(http.StatusUnsupportedMediaType, "ReadJSON failed: "+err.Error())
+		}
+		Panic(http.StatusBadRequest, "ReadJSON failed: "+err.Error())
+	}
 	defer r.Body.Close()
 	decoder := json.NewDecoder(r.Body)
 	err := decoder.Decode(obj)
-	if err != nil {
+	if errors.Is(err, ErrBodyTooLarge) {
+		Panic(http.StatusRequestEntityTooLarge, "ReadJSON failed: "+err.Error())
+	} else if err != nil {
 		Panic(http.StatusBadRequest, "ReadJSON failed: Failed to decode JSON - "+err.Error())
 	}
 }
@@ -143,7 +207,8 @@ func SendOK(w http.ResponseWriter) {
 }
 
 // SendPong sends a reply to an HTTP ping request, which checks if the service
-// is alive.
+// is alive. This always succeeds, so prefer HandleHealth if your service has
+// dependencies (such as a database) that need to be checked.
 func SendPong(w http.ResponseWriter) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Cache-Control", "max-age=0, no-cache")
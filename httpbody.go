@@ -0,0 +1,106 @@
+package nf
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// MaxDecompressedBodySize limits the size of a compressed request body after decompression, to protect us from zip bombs.
+var MaxDecompressedBodySize int64 = 64 * 1024 * 1024
+
+// ErrBodyTooLarge is returned when reading a decompressed request body that exceeds MaxDecompressedBodySize.
+var ErrBodyTooLarge = errors.New("Request body is too large")
+
+// errUnsupportedEncoding is returned by DecodeRequestBody for an encoding other than gzip or deflate
+var errUnsupportedEncoding = errors.New("Unsupported Content-Encoding")
+
+// DecodeRequestBody replaces r.Body with a reader that decompresses a gzip or deflate encoded body, and removes
+// the Content-Encoding header, so that calling it twice is harmless. If the body is not encoded, then r is left untouched.
+// This is done automatically for routes registered through nf, and by ReadJSON.
+func DecodeRequestBody(r *http.Request) error {
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	if encoding == "" || encoding == "identity" || r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+	var decoded io.ReadCloser
+	var err error
+	switch encoding {
+	case "gzip", "x-gzip":
+		decoded, err = gzip.NewReader(r.Body)
+	case "deflate":
+		decoded, err = newDeflateReader(r.Body)
+	default:
+		return fmt.Errorf("%w: %v", errUnsupportedEncoding, encoding)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to decode %v request body: %w", encoding, err)
+	}
+	r.Body = &decodedBody{
+		decoded:  decoded,
+		original: r.Body,
+		limited:  io.LimitReader(decoded, MaxDecompressedBodySize+1),
+		max:      MaxDecompressedBodySize,
+	}
+	r.Header.Del("Content-Encoding")
+	r.Header.Del("Content-Length")
+	r.ContentLength = -1
+	return nil
+}
+
+// newDeflateReader handles "deflate" bodies, which are supposed to be zlib-wrapped (RFC 7230), but some
+// clients send raw deflate data, so we accept both.
+func newDeflateReader(body io.Reader) (io.ReadCloser, error) {
+	buf := bufio.NewReader(body)
+	header, err := buf.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+	if header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(buf)
+	}
+	return flate.NewReader(buf), nil
+}
+
+type decodedBody struct {
+	decoded  io.ReadCloser
+	original io.ReadCloser
+	limited  io.Reader
+	max      int64
+	total    int64
+}
+
+func (d *decodedBody) Read(p []byte) (int, error) {
+	n, err := d.limited.Read(p)
+	d.total += int64(n)
+	if d.total > d.max {
+		return 0, ErrBodyTooLarge
+	}
+	return n, err
+}
+
+func (d *decodedBody) Close() error {
+	d.decoded.Close()
+	return d.original.Close()
+}
+
+// decodeRequestBodyOrFail calls DecodeRequestBody, and sends an error response if that fails.
+// Returns false if the request must not proceed.
+func decodeRequestBodyOrFail(w http.ResponseWriter, r *http.Request) bool {
+	err := DecodeRequestBody(r)
+	if err == nil {
+		return true
+	}
+	if errors.Is(err, errUnsupportedEncoding) {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+	} else {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+package nf
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// StaticDevProxy forwards all static file and index.html requests to a front-end development server (eg webpack or vite),
+// so that during development you only need to open the port of your Go service. Websocket upgrades are forwarded too,
+// so hot reload works. Your APIs are still served by your own handlers.
+// The dev server must serve the front-end under the same publicPath (eg base: '/facilities/' in vite.config.js).
+// When this option is given, HandleStaticFiles does not look for www/dist, and HandleStaticFilesFS ignores its fsys.
+// The function panics if devServerURL is invalid.
+func StaticDevProxy(devServerURL string) StaticOption {
+	target, err := url.Parse(devServerURL)
+	if err != nil || target.Scheme == "" || target.Host == "" {
+		panic(fmt.Sprintf("Invalid dev server URL '%v'", devServerURL))
+	}
+	return func(c *staticConfig) {
+		c.devProxy = target
+	}
+}
+
+func newDevProxy(target *url.URL) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.SetXForwarded()
+			// SetURL joins the paths, but the dev server expects the same path that we received
+			pr.Out.URL.Path = pr.In.URL.Path
+			pr.Out.URL.RawPath = pr.In.URL.RawPath
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			http.Error(w, fmt.Sprintf("Front-end dev server at %v is not responding: %v", target, err), http.StatusBadGateway)
+		},
+	}
+}
+
+// handleDevProxy registers the same routes as handleStaticFS, but all of them are served by the dev server
+func handleDevProxy(router *httprouter.Router, publicPath string, config staticConfig) {
+	proxy := newDevProxy(config.devProxy)
+	opts := config.routeOptions()
+	handleStatic(router, publicPath+"/static/*path", opts, proxy.ServeHTTP)
+	handleStatic(router, publicPath+"/robots.txt", opts, proxy.ServeHTTP)
+	handleStatic(router, publicPath+"/favicon.ico", opts, proxy.ServeHTTP)
+	fallback := newFallback(&staticFiles{publicPath: publicPath}, config)
+	fallback.proxy = proxy
+	setFallback(router, publicPath, fallback, opts)
+}
@@ -0,0 +1,178 @@
+package nf
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IndexTemplate causes HandleStaticFiles to render index.html as an html/template, so that the front-end
+// can learn about its environment without an extra API call. For example:
+//
+//	<base href="{{.PublicPath}}/">
+//	<script>window.imqs = {version: {{.Version}}, config: {{.Config}}};</script>
+//
+// html/template escapes the values for their context, so .Config becomes a JSON object inside a script.
+// If the Content-Security-Policy has a nonce (see SecurityHeaders), then it is available as {{.Nonce}}.
+type IndexTemplate struct {
+	Version string      // The version of the service
+	Config  interface{} // Marshalled to JSON, after which only the top-level fields in ConfigKeys are kept
+	// ConfigKeys is the whitelist of the fields of Config that are sent to the browser.
+	// This exists so that secrets in the service config (eg DB passwords) cannot leak into the front-end.
+	ConfigKeys []string
+}
+
+// IndexData is the data that index.html is rendered with. See IndexTemplate.
+type IndexData struct {
+	PublicPath string
+	Version    string
+	Config     map[string]interface{}
+	Nonce      string // The Content-Security-Policy nonce of the response, or empty
+}
+
+// StaticIndexTemplate renders index.html as a template. The result is cached, and rendered again when index.html changes.
+// The function panics if Config cannot be marshalled to a JSON object.
+func StaticIndexTemplate(t IndexTemplate) StaticOption {
+	return func(c *staticConfig) {
+		c.index = &t
+	}
+}
+
+// scriptOrStyleTag matches the opening tag of a <script> or <style> element
+var scriptOrStyleTag = regexp.MustCompile(`(?i)<(script|style)\b[^>]*>`)
+
+// indexRenderer renders index.html, and keeps the result until the file changes.
+// It is also used for an index.html that is not a template, if it needs a CSP nonce.
+type indexRenderer struct {
+	fsys     fs.FS
+	name     string
+	template bool
+	data     IndexData
+	sentinel string // Stands in for the nonce in the cached output, so that we don't need to render for every request
+
+	lock      sync.Mutex
+	modTime   time.Time
+	size      int64
+	rendered  []byte // Without a nonce
+	withNonce []byte // With the nonce sentinel in every <script> and <style> tag
+	etag      string
+}
+
+// newIndexRenderer creates a renderer of index.html. If t is nil, then the file is not a template.
+func newIndexRenderer(fsys fs.FS, name, publicPath string, t *IndexTemplate) *indexRenderer {
+	if t == nil {
+		return &indexRenderer{fsys: fsys, name: name, sentinel: "nfnonce" + newRandomToken()}
+	}
+	config := map[string]interface{}{}
+	if t.Config != nil {
+		raw, err := json.Marshal(t.Config)
+		if err != nil {
+			panic(fmt.Sprintf("Unable to marshal IndexTemplate.Config: %v", err))
+		}
+		all := map[string]interface{}{}
+		if err := json.Unmarshal(raw, &all); err != nil {
+			panic(fmt.Sprintf("IndexTemplate.Config must be a JSON object: %v", err))
+		}
+		for _, key := range t.ConfigKeys {
+			if v, ok := all[key]; ok {
+				config[key] = v
+			}
+		}
+	}
+	sentinel := "nfnonce" + strings.ReplaceAll(newRandomToken(), "-", "")
+	return &indexRenderer{
+		fsys:     fsys,
+		name:     name,
+		template: true,
+		sentinel: sentinel,
+		data: IndexData{
+			PublicPath: publicPath,
+			Version:    t.Version,
+			Config:     config,
+			Nonce:      sentinel,
+		},
+	}
+}
+
+// get returns the rendered index.html, rendering it again if the file has changed since the last time.
+// If nonce is true, then content has the nonce sentinel.
+func (ir *indexRenderer) get(nonce bool) (content []byte, modTime time.Time, etag string, err error) {
+	st, err := fs.Stat(ir.fsys, ir.name)
+	if err != nil {
+		return nil, time.Time{}, "", err
+	}
+	ir.lock.Lock()
+	defer ir.lock.Unlock()
+	if ir.rendered == nil || !st.ModTime().Equal(ir.modTime) || st.Size() != ir.size {
+		if err := ir.render(st); err != nil {
+			return nil, time.Time{}, "", err
+		}
+	}
+	if nonce {
+		return ir.withNonce, ir.modTime, ir.etag, nil
+	}
+	return ir.rendered, ir.modTime, ir.etag, nil
+}
+
+// render must be called with the lock held
+func (ir *indexRenderer) render(st fs.FileInfo) error {
+	raw, err := fs.ReadFile(ir.fsys, ir.name)
+	if err != nil {
+		return err
+	}
+	content := raw
+	if ir.template {
+		tpl, err := template.New(ir.name).Parse(string(raw))
+		if err != nil {
+			return err
+		}
+		buf := bytes.Buffer{}
+		if err := tpl.Execute(&buf, ir.data); err != nil {
+			return err
+		}
+		content = buf.Bytes()
+	}
+	nonceAttrib := []byte(` nonce="` + ir.sentinel + `"`)
+	ir.withNonce = scriptOrStyleTag.ReplaceAllFunc(content, func(tag []byte) []byte {
+		if bytes.Contains(bytes.ToLower(tag), []byte("nonce=")) {
+			return tag
+		}
+		name := scriptOrStyleTag.FindSubmatchIndex(tag)[3]
+		return append(append(append([]byte{}, tag[:name]...), nonceAttrib...), tag[name:]...)
+	})
+	ir.rendered = bytes.ReplaceAll(bytes.ReplaceAll(content, nonceAttrib, nil), []byte(ir.sentinel), nil)
+	hash := sha256.Sum256(ir.rendered)
+	ir.modTime = st.ModTime()
+	ir.size = st.Size()
+	ir.etag = `"` + base64.RawURLEncoding.EncodeToString(hash[:16]) + `"`
+	return nil
+}
+
+func (ir *indexRenderer) serve(w http.ResponseWriter, r *http.Request) {
+	nonce := CSPNonce(r)
+	content, modTime, etag, err := ir.get(nonce != "")
+	if err != nil {
+		http.Error(w, "Failed to render index.html: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if nonce != "" {
+		// The nonce is different for every response, so the browser must not use a cached copy
+		content = bytes.ReplaceAll(content, []byte(ir.sentinel), []byte(nonce))
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Del("Expires")
+		http.ServeContent(w, r, ir.name, time.Time{}, bytes.NewReader(content))
+		return
+	}
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, r, ir.name, modTime, bytes.NewReader(content))
+}
@@ -1,43 +1,336 @@
 package nf
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/fs"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
 
+	"github.com/IMQS/serviceauth"
+	"github.com/IMQS/serviceauth/permissions"
 	"github.com/julienschmidt/httprouter"
 )
 
-type httpFallback struct {
-	publicPath string // eg /facilities, or /leasing (prefix of URL)
-	indexFile  string // eg /var/www/index.html (absolute path on disk)
+// StaticOption changes the behaviour of HandleStaticFiles and HandleStaticFilesFS.
+type StaticOption func(c *staticConfig)
+
+type staticConfig struct {
+	dir            string
+	fingerprint    *regexp.Regexp
+	fingerprintSet bool
+	manifest       string
+	index          *IndexTemplate
+	loginURL       string
+	isLoggedIn     func(r *http.Request) bool
+	devProxy       *url.URL
+	notFound       http.Handler
+	assetExts      []string
+	apiNotFound    http.Handler
+	security       *SecurityHeaders
+	securitySet    bool
 }
 
-func (h *httpFallback) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+// routeOptions are the options of the routes that are registered for the static files
+func (c *staticConfig) routeOptions() []RouteOption {
+	opts := []RouteOption{staticRoute}
+	if c.securitySet {
+		opts = append(opts, Security(c.security))
+	}
+	return opts
+}
+
+// StaticDir serves the files in dir, instead of searching for www/dist or /var/www. Only applies to HandleStaticFiles.
+func StaticDir(dir string) StaticOption {
+	return func(c *staticConfig) {
+		c.dir = dir
+	}
+}
+
+// DefaultFingerprint matches the content hash that bundlers such as webpack and vite put into file names,
+// eg main.3f2a9c1b.js or index-B2xk9_Qa.css. The hash must be at least 8 characters, and contain a digit,
+// so that names such as main-polyfill.js are not mistaken for fingerprinted files.
+var DefaultFingerprint = regexp.MustCompile(`[.-]([0-9A-Za-z_]{8,})\.[0-9A-Za-z]+$`)
+
+// immutableCacheControl is sent with fingerprinted files. Their content never changes, because a new build gives them a new name.
+const immutableCacheControl = "public, max-age=31536000, immutable"
+
+// StaticFingerprint replaces DefaultFingerprint. The first capture group of pattern must be the hash.
+// Pass nil to treat only the files in the StaticManifest as fingerprinted.
+func StaticFingerprint(pattern *regexp.Regexp) StaticOption {
+	return func(c *staticConfig) {
+		c.fingerprint = pattern
+		c.fingerprintSet = true
+	}
+}
+
+// StaticManifest names a JSON build manifest inside the static files (eg "manifest.json" from vite, or "assets-manifest.json"
+// from webpack). Every string in the manifest that names one of the static files marks that file as fingerprinted,
+// regardless of its name. The function panics if the manifest cannot be read.
+func StaticManifest(name string) StaticOption {
+	return func(c *staticConfig) {
+		c.manifest = name
+	}
+}
+
+// StaticLoginRedirect sends users who are not logged in to loginURL, when they navigate to a page of the front-end.
+// The original URL is preserved in the "redirect" query parameter, eg /login?redirect=/facilities/assets.
+// isLoggedIn decides whether the user is logged in. If nil, then the session is checked with the auth service.
+// Only HTML page navigations are redirected. Static files, APIs and requests from scripts are left alone,
+// so that a script receives an error that it can handle, instead of the login page.
+func StaticLoginRedirect(loginURL string, isLoggedIn func(r *http.Request) bool) StaticOption {
+	return func(c *staticConfig) {
+		c.loginURL = loginURL
+		c.isLoggedIn = isLoggedIn
+	}
+}
+
+// isLoggedInServiceAuth checks the session with the auth service
+func isLoggedInServiceAuth(r *http.Request) bool {
+	if BypassAuth {
+		return true
+	}
+	code, _, token := serviceauth.GetToken(r)
+	return code == http.StatusOK && (token.IsInterService || token.HasPermByID(permissions.PermEnabled))
+}
+
+// isNavigation returns true if r is the browser loading a page, as opposed to a script or an image
+func isNavigation(r *http.Request) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	if mode := r.Header.Get("Sec-Fetch-Mode"); mode != "" {
+		return mode == "navigate"
+	}
+	// Older browsers don't send Sec-Fetch-Mode
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// DefaultAssetExtensions are the file extensions that StaticNotFound treats as assets, if it is not given any extensions.
+var DefaultAssetExtensions = []string{".js", ".mjs", ".css", ".map", ".json", ".png", ".jpg", ".jpeg", ".gif", ".svg", ".ico", ".webp", ".woff", ".woff2", ".ttf", ".wasm"}
+
+// StaticNotFound sends a real 404 for missing assets, instead of index.html. Without this, a missing script
+// produces a confusing syntax error in the browser, because it receives index.html instead of the script.
+// A request is for an asset if its path is under /static/, or ends in one of exts (DefaultAssetExtensions if exts is empty).
+// notFound sends the 404 response. If nil, then a plain text 404 is sent.
+func StaticNotFound(notFound http.Handler, exts ...string) StaticOption {
+	if notFound == nil {
+		notFound = http.NotFoundHandler()
+	}
+	if len(exts) == 0 {
+		exts = DefaultAssetExtensions
+	}
+	return func(c *staticConfig) {
+		c.notFound = notFound
+		c.assetExts = exts
+	}
+}
+
+// StaticAPINotFound sends the response for a path under publicPath/api/ that doesn't match any of your routes.
+// By default, such requests receive 404 with the body "Not a valid API".
+func StaticAPINotFound(handler http.Handler) StaticOption {
+	return func(c *staticConfig) {
+		c.apiNotFound = handler
+	}
+}
+
+// StaticSecurity sets the security headers of the static files and index.html, overriding DefaultSecurityHeaders.
+func StaticSecurity(headers *SecurityHeaders) StaticOption {
+	return func(c *staticConfig) {
+		c.security = headers
+		c.securitySet = true
+	}
+}
+
+// staticFiles serves the files of a single front-end
+type staticFiles struct {
+	publicPath  string // eg /facilities, or /leasing (prefix of URL)
+	fsys        fs.FS
+	etags       sync.Map // file name -> ETag, for files that have no modification time (eg embed.FS)
+	fingerprint *regexp.Regexp
+	manifest    map[string]bool // Files that are fingerprinted according to the build manifest
+}
+
+// isFingerprinted returns true if the name of the file includes a hash of its content
+func (s *staticFiles) isFingerprinted(name string) bool {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if s.manifest[name] {
+		return true
+	}
+	if s.fingerprint == nil || name == "index.html" {
+		return false
+	}
+	m := s.fingerprint.FindStringSubmatch(path.Base(name))
+	return len(m) > 1 && strings.ContainsAny(m[1], "0123456789")
+}
+
+// addCacheHeaders sends fingerprinted files with a long expiry time, and everything else with addCacheExpiryHeaders.
+// A fingerprinted name that doesn't exist must not be cached, because it may exist after the next deployment.
+func (s *staticFiles) addCacheHeaders(w http.ResponseWriter, name string) {
+	if s.isFingerprinted(name) {
+		if _, err := fs.Stat(s.fsys, strings.TrimPrefix(path.Clean("/"+name), "/")); err == nil {
+			w.Header().Set("Cache-Control", immutableCacheControl)
+			return
+		}
+	}
 	addCacheExpiryHeaders(w)
+}
+
+// loadManifest reads the names of the fingerprinted files out of a build manifest. We don't care about the
+// structure of the manifest, so every string value that names a file is taken to be a fingerprinted file.
+func (s *staticFiles) loadManifest(name string) {
+	raw, err := fs.ReadFile(s.fsys, name)
+	if err != nil {
+		panic(fmt.Sprintf("Unable to read static files manifest: %v", err))
+	}
+	var doc interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		panic(fmt.Sprintf("Unable to parse static files manifest %v: %v", name, err))
+	}
+	s.manifest = map[string]bool{}
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case string:
+			// Manifests may contain URLs (eg /facilities/static/main.js) or names relative to the output directory
+			file := strings.TrimPrefix(v, s.publicPath+"/static/")
+			file = strings.TrimPrefix(path.Clean("/"+file), "/")
+			if file != "index.html" {
+				if st, err := fs.Stat(s.fsys, file); err == nil && !st.IsDir() {
+					s.manifest[file] = true
+				}
+			}
+		case []interface{}:
+			for _, x := range v {
+				walk(x)
+			}
+		case map[string]interface{}:
+			for _, x := range v {
+				walk(x)
+			}
+		}
+	}
+	walk(doc)
+}
 
-	//fmt.Printf("fallback: %v\n", r.RequestURI)
-	if h.publicPath != "" && !strings.HasPrefix(r.URL.Path, h.publicPath) {
-		http.Error(w, "Invalid router config. All URLs to this service should being with "+h.publicPath, 404)
+// setETag sets a content-based ETag for files that have no modification time, such as the files in an embed.FS.
+// Without this, the browser would have nothing to revalidate with, and would download such files again every time.
+func (s *staticFiles) setETag(w http.ResponseWriter, name string) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return
+	}
+	if etag, ok := s.etags.Load(name); ok {
+		if etag != "" {
+			w.Header().Set("ETag", etag.(string))
+		}
 		return
 	}
+	etag := ""
+	if f, err := s.fsys.Open(name); err == nil {
+		defer f.Close()
+		if st, err := f.Stat(); err == nil && !st.IsDir() && st.ModTime().IsZero() {
+			h := sha256.New()
+			if _, err := io.Copy(h, f); err == nil {
+				etag = `"` + base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:16]) + `"`
+			}
+		}
+	} else {
+		// Don't cache misses, otherwise a client could fill up our cache with junk
+		return
+	}
+	s.etags.Store(name, etag)
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+}
+
+type httpFallback struct {
+	*staticFiles
+	indexFile  string         // eg index.html (name inside fsys)
+	index      *indexRenderer // nil if index.html is not a template
+	loginURL   string         // empty if we don't redirect to the login page
+	isLoggedIn func(r *http.Request) bool
+	proxy      http.Handler // Front-end dev server (see StaticDevProxy)
+
+	notFound    http.Handler // nil if missing assets receive index.html
+	assetExts   []string
+	apiNotFound http.Handler // nil for the default "Not a valid API"
+}
+
+// isAsset returns true if the path looks like a request for a file, as opposed to a page of the app
+func (h *httpFallback) isAsset(urlPath string) bool {
+	ext := strings.ToLower(path.Ext(urlPath))
+	for _, e := range h.assetExts {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *httpFallback) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.proxy == nil {
+		// The dev server sends its own cache headers
+		addCacheExpiryHeaders(w)
+	}
+
 	if strings.HasPrefix(r.URL.Path, h.publicPath+"/api/") {
-		// This is helpful for developers, instead of just getting back index.html
-		http.Error(w, "Not a valid API", 404)
+		if h.apiNotFound != nil {
+			h.apiNotFound.ServeHTTP(w, r)
+		} else {
+			// This is helpful for developers, instead of just getting back index.html
+			http.Error(w, "Not a valid API", 404)
+		}
+		return
+	}
+	if h.notFound != nil && h.proxy == nil && h.isAsset(r.URL.Path) {
+		h.notFound.ServeHTTP(w, r)
+		return
+	}
+	if h.loginURL != "" && isNavigation(r) && !h.isLoggedIn(r) {
+		h.redirectToLogin(w, r)
+		return
+	}
+
+	if h.proxy != nil {
+		h.proxy.ServeHTTP(w, r)
+		return
+	}
+	if h.index != nil {
+		h.index.serve(w, r)
+		return
+	}
+	h.setETag(w, h.indexFile)
+	if servePrecompressed(w, r, h.fsys, h.indexFile) {
 		return
 	}
-	// Experimental code for the sake of making the signout redirect working
-	// // If the user is not logged in, the user will be redirected to the Login page
-	// if httpCode, _, _ := serviceauth.VerifyUserHasPermission(r, "enabled"); httpCode != http.StatusOK {
-	// 	r.URL.Query().Set("redirect", r.URL.Path)
-	// 	url := fmt.Sprintf("/login?redirect=%v", q)
-	// 	http.Redirect(w, r, url, http.StatusUnauthorized)
-	// 	return
-	// }
+	http.ServeFileFS(w, r, h.fsys, h.indexFile)
+}
 
-	http.ServeFile(w, r, h.indexFile)
+// redirectToLogin sends the user to the login page, which will send them back to where they were after logging in
+func (h *httpFallback) redirectToLogin(w http.ResponseWriter, r *http.Request) {
+	login, err := url.Parse(h.loginURL)
+	if err != nil || login.Path == r.URL.Path {
+		// Don't redirect the login page to itself
+		http.Error(w, "Not logged in", http.StatusUnauthorized)
+		return
+	}
+	q := login.Query()
+	q.Set("redirect", r.URL.RequestURI())
+	login.RawQuery = q.Encode()
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, login.String(), http.StatusFound)
 }
 
 func pathExists(fn string) bool {
@@ -68,22 +361,33 @@ func addCacheExpiryHeaders(w http.ResponseWriter) {
 }
 
 // HandleStaticFiles creates a catch-all handler that serves up static files if they exist, or returns /index.html if the path does not exist.
+// Files with a content hash in their name (see DefaultFingerprint and StaticManifest) are cached by the browser for a year.
+// Everything else, including index.html, must be revalidated by the browser every time.
+// You may call this several times with different publicPaths, to serve several front-ends from one router.
+// Requests that don't match any publicPath go to the router's NotFound handler, if you set it before calling this.
+// If a file has a pre-built .br or .gz sibling (eg main.js.gz), and the client accepts that encoding, then the sibling is sent instead.
 // publicPath is something like '/facilities', '/leasing', or whatever your root path is in the IMQS router.
 // publicPath may also be empty, if this service runs alone.
-// The function first tries to see if www/dist exists, relative to the current directory, and if this does exist, then it uses that.
+// If the StaticDir option is given, then the files are served from that directory, and the function panics if it does not exist.
+// Otherwise, the function first tries to see if www/dist exists, relative to the current directory, and if this does exist, then it uses that.
 // If www/dist does not exist, and we're running in a container, then the function looks for /var/www, and if that exists, then it uses that.
 // If neither of these options succeed, then the function panics
-func HandleStaticFiles(router *httprouter.Router, publicPath string) {
-	if publicPath != "" && publicPath[0] != '/' {
-		panic("publicPath must either be empty, or start with a slash")
+func HandleStaticFiles(router *httprouter.Router, publicPath string, opts ...StaticOption) {
+	config := staticConfig{}
+	for _, opt := range opts {
+		opt(&config)
 	}
-	if publicPath != "" && publicPath[len(publicPath)-1] == '/' {
-		// remove trailing slash
-		publicPath = publicPath[:len(publicPath)-1]
+	if config.devProxy != nil {
+		handleStaticFS(router, publicPath, nil, config)
+		return
 	}
-	pwd, _ := os.Getwd()
-	wwwFilesRoot := ""
-	{
+	wwwFilesRoot := config.dir
+	if wwwFilesRoot != "" {
+		if !pathExists(wwwFilesRoot) {
+			panic(fmt.Sprintf("Static files directory %v does not exist", wwwFilesRoot))
+		}
+	} else {
+		pwd, _ := os.Getwd()
 		relative := filepath.Join(pwd, "www", "dist")
 		container := "/var/www"
 		if pathExists(relative) {
@@ -95,37 +399,213 @@ func HandleStaticFiles(router *httprouter.Router, publicPath string) {
 			panic(fmt.Sprintf("Unable to find a 'www' root directory in %v or %v", relative, container))
 		}
 	}
+	handleStaticFS(router, publicPath, os.DirFS(wwwFilesRoot), config)
+}
+
+// HandleStaticFilesFS is HandleStaticFiles, but the files come from fsys, which is typically an embed.FS,
+// so that the front-end ships inside the Go binary. fsys must have index.html at its root, so use fs.Sub
+// to strip the directory of the embed pattern:
+//
+//	//go:embed www/dist
+//	var wwwDist embed.FS
+//	...
+//	dist, _ := fs.Sub(wwwDist, "www/dist")
+//	nf.HandleStaticFilesFS(router, "/facilities", dist)
+//
+// Files without a modification time (which is true of all files in an embed.FS) receive an ETag based on their content.
+func HandleStaticFilesFS(router *httprouter.Router, publicPath string, fsys fs.FS, opts ...StaticOption) {
+	config := staticConfig{}
+	for _, opt := range opts {
+		opt(&config)
+	}
+	handleStaticFS(router, publicPath, fsys, config)
+}
+
+func handleStaticFS(router *httprouter.Router, publicPath string, fsys fs.FS, config staticConfig) {
+	if publicPath != "" && publicPath[0] != '/' {
+		panic("publicPath must either be empty, or start with a slash")
+	}
+	if publicPath != "" && publicPath[len(publicPath)-1] == '/' {
+		// remove trailing slash
+		publicPath = publicPath[:len(publicPath)-1]
+	}
+	if config.devProxy != nil {
+		handleDevProxy(router, publicPath, config)
+		return
+	}
 
+	files := &staticFiles{
+		publicPath:  publicPath,
+		fsys:        fsys,
+		fingerprint: DefaultFingerprint,
+	}
+	if config.fingerprintSet {
+		files.fingerprint = config.fingerprint
+	}
+	if config.manifest != "" {
+		files.loadManifest(config.manifest)
+	}
 	publicStatic := publicPath + "/static"
 
 	// This strips "/facilities/static"
-	staticFilesStrip := http.StripPrefix(publicStatic, http.FileServer(http.Dir(wwwFilesRoot)))
-
-	router.Handle("GET", publicStatic+"/*path", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-		addCacheExpiryHeaders(w)
+	staticFilesStrip := http.StripPrefix(publicStatic, http.FileServerFS(fsys))
 
-		//fmt.Printf("GET %v: %v\n", publicStatic, r.RequestURI)
+	opts := config.routeOptions()
+	handleStatic(router, publicStatic+"/*path", opts, func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, publicStatic)
+		files.addCacheHeaders(w, name)
+		if config.notFound != nil {
+			if _, err := fs.Stat(fsys, strings.TrimPrefix(path.Clean("/"+name), "/")); err != nil {
+				config.notFound.ServeHTTP(w, r)
+				return
+			}
+		}
+		files.setETag(w, name)
+		if servePrecompressed(w, r, fsys, name) {
+			return
+		}
 		staticFilesStrip.ServeHTTP(w, r)
 	})
 
 	// I suspect these URLs will never be hit, but it seems prudent to leave them in
 	var staticFiles http.Handler
 	if publicPath == "" {
-		staticFiles = http.FileServer(http.Dir(wwwFilesRoot))
+		staticFiles = http.FileServerFS(fsys)
 	} else {
 		// This strips "/facilities"
-		staticFiles = http.StripPrefix(publicPath, http.FileServer(http.Dir(wwwFilesRoot)))
+		staticFiles = http.StripPrefix(publicPath, http.FileServerFS(fsys))
 	}
-	router.Handle("GET", publicPath+"/robots.txt", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-		staticFiles.ServeHTTP(w, r)
-	})
-	router.Handle("GET", publicPath+"/favicon.ico", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-		staticFiles.ServeHTTP(w, r)
-	})
+	handleStatic(router, publicPath+"/robots.txt", opts, staticFiles.ServeHTTP)
+	handleStatic(router, publicPath+"/favicon.ico", opts, staticFiles.ServeHTTP)
 
 	// Everything else returns index.html
-	router.NotFound = &httpFallback{
+	fallback := newFallback(files, config)
+	security := DefaultSecurityHeaders
+	if config.securitySet {
+		security = config.security
+	}
+	if config.index != nil || (security != nil && security.usesNonce()) {
+		fallback.index = newIndexRenderer(fsys, fallback.indexFile, publicPath, config.index)
+		if _, _, _, err := fallback.index.get(false); err != nil {
+			panic(fmt.Sprintf("Failed to render index.html: %v", err))
+		}
+	}
+	setFallback(router, publicPath, fallback, opts)
+}
+
+func newFallback(files *staticFiles, config staticConfig) *httpFallback {
+	fallback := &httpFallback{
+		staticFiles: files,
+		indexFile:   "index.html",
+		notFound:    config.notFound,
+		assetExts:   config.assetExts,
+		apiNotFound: config.apiNotFound,
+	}
+	if config.loginURL != "" {
+		fallback.loginURL = config.loginURL
+		fallback.isLoggedIn = config.isLoggedIn
+		if fallback.isLoggedIn == nil {
+			fallback.isLoggedIn = isLoggedInServiceAuth
+		}
+	}
+	return fallback
+}
+
+// spaMount is the fallback of a single front-end
+type spaMount struct {
+	publicPath string
+	fallback   *httpFallback
+	stats      *routeStats
+	security   *SecurityHeaders
+}
+
+func (m *spaMount) matches(urlPath string) bool {
+	return m.publicPath == "" || urlPath == m.publicPath || strings.HasPrefix(urlPath, m.publicPath+"/")
+}
+
+// spaMounts is the router.NotFound handler of a router that has one or more front-ends. It sends each request
+// to the front-end with the longest matching publicPath.
+type spaMounts struct {
+	lock     sync.RWMutex
+	mounts   []*spaMount  // Sorted by descending length of publicPath
+	previous http.Handler // The router's NotFound handler before we replaced it
+}
+
+var spaMountsLock sync.Mutex
+var spaMountsByRouter = map[*httprouter.Router]*spaMounts{}
+
+// setFallback makes fallback the handler of every request under publicPath that doesn't match a route.
+// Requests that aren't under the publicPath of any front-end go to the router's original NotFound handler, if it had one.
+func setFallback(router *httprouter.Router, publicPath string, fallback *httpFallback, opts []RouteOption) {
+	spaMountsLock.Lock()
+	defer spaMountsLock.Unlock()
+	m := spaMountsByRouter[router]
+	if m == nil {
+		m = &spaMounts{previous: router.NotFound}
+		spaMountsByRouter[router] = m
+		router.NotFound = m
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, existing := range m.mounts {
+		if existing.publicPath == publicPath {
+			panic(fmt.Sprintf("Static files are already being served at '%v'", publicPath))
+		}
+	}
+	route := newRoute("GET", publicPath+"/*", false, nil, opts)
+	m.mounts = append(m.mounts, &spaMount{
 		publicPath: publicPath,
-		indexFile:  filepath.Join(wwwFilesRoot, "index.html"),
+		fallback:   fallback,
+		stats:      route.stats,
+		security:   route.security,
+	})
+	sort.SliceStable(m.mounts, func(i, j int) bool {
+		return len(m.mounts[i].publicPath) > len(m.mounts[j].publicPath)
+	})
+}
+
+func (m *spaMounts) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.lock.RLock()
+	var mount *spaMount
+	paths := []string{}
+	for _, candidate := range m.mounts {
+		if mount == nil && candidate.matches(r.URL.Path) {
+			mount = candidate
+		}
+		paths = append(paths, candidate.publicPath)
 	}
+	m.lock.RUnlock()
+
+	if mount != nil {
+		sw := mount.stats.begin(w)
+		if mount.security != nil {
+			r = mount.security.setHeaders(sw, r)
+		}
+		mount.fallback.ServeHTTP(sw, r)
+		mount.stats.end(sw, nil)
+	} else if m.previous != nil {
+		m.previous.ServeHTTP(w, r)
+	} else {
+		sort.Strings(paths)
+		http.Error(w, "Invalid router config. All URLs to this service should begin with one of "+strings.Join(paths, ", "), 404)
+	}
+}
+
+func staticRoute(r *Route) {
+	r.Static = true
+}
+
+// handleStatic registers a GET handler for static content, so that it shows up in Routes and in the metrics
+func handleStatic(router *httprouter.Router, path string, opts []RouteOption, handle http.HandlerFunc) {
+	route := newRoute("GET", path, false, nil, opts)
+	stats := route.stats
+	security := route.security
+	router.Handle("GET", path, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		sw := stats.begin(w)
+		if security != nil {
+			r = security.setHeaders(sw, r)
+		}
+		handle(sw, r)
+		stats.end(sw, nil)
+	})
 }
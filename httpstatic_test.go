@@ -0,0 +1,196 @@
+package nf
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"gotest.tools/v3/assert"
+)
+
+func TestStaticFilesFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"index.html": {Data: []byte("<html>app</html>")},
+		"main.js":    {Data: []byte("console.log(1)")},
+	}
+	router := httprouter.New()
+	HandleStaticFilesFS(router, "/facilities", fsys)
+
+	get := func(path, etag string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		if etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("/facilities/static/main.js", "")
+	assert.Equal(t, w.Code, 200)
+	assert.Equal(t, w.Body.String(), "console.log(1)")
+	etag := w.Header().Get("ETag")
+	assert.Assert(t, etag != "")
+	assert.Equal(t, get("/facilities/static/main.js", etag).Code, http.StatusNotModified)
+
+	// SPA fallback
+	w = get("/facilities/assets/12", "")
+	assert.Equal(t, w.Code, 200)
+	assert.Equal(t, w.Body.String(), "<html>app</html>")
+	assert.Equal(t, get("/facilities/api/nope", "").Code, 404)
+}
+
+func TestStaticCachePolicy(t *testing.T) {
+	fsys := fstest.MapFS{
+		"index.html":           {Data: []byte("<html>app</html>")},
+		"main.3f2a9c1b.js":     {Data: []byte("hashed")},
+		"main-polyfill.js":     {Data: []byte("not hashed")},
+		"assets/chunk.js":      {Data: []byte("listed in the manifest")},
+		"assets-manifest.json": {Data: []byte(`{"chunk.js": "/app/static/assets/chunk.js", "missing.js": "assets/missing.js"}`)},
+	}
+	router := httprouter.New()
+	HandleStaticFilesFS(router, "/app", fsys, StaticManifest("assets-manifest.json"))
+
+	cacheControl := func(path string) string {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Header().Get("Cache-Control")
+	}
+	assert.Equal(t, cacheControl("/app/static/main.3f2a9c1b.js"), immutableCacheControl)
+	assert.Equal(t, cacheControl("/app/static/assets/chunk.js"), immutableCacheControl)
+	assert.Equal(t, cacheControl("/app/static/main-polyfill.js"), "public, must-revalidate")
+	assert.Equal(t, cacheControl("/app/static/main.00000000.js"), "public, must-revalidate")
+	assert.Equal(t, cacheControl("/app/somewhere"), "public, must-revalidate")
+}
+
+func TestStaticIndexTemplate(t *testing.T) {
+	fsys := fstest.MapFS{
+		"index.html": {Data: []byte(`<base href="{{.PublicPath}}/"><script>v={{.Version}};c={{.Config}}</script>`)},
+	}
+	config := struct {
+		MapServer  string
+		DBPassword string
+	}{"https://maps.example.com", "secret"}
+	router := httprouter.New()
+	HandleStaticFilesFS(router, "/app", fsys, StaticIndexTemplate(IndexTemplate{Version: "1.2", Config: config, ConfigKeys: []string{"MapServer"}}))
+
+	get := func() string {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/app/assets", nil))
+		return w.Body.String()
+	}
+	assert.Equal(t, get(), `<base href="/app/"><script>v="1.2";c={"MapServer":"https://maps.example.com"}</script>`)
+
+	fsys["index.html"] = &fstest.MapFile{Data: []byte(`{{.Version}}`), ModTime: time.Now()}
+	assert.Equal(t, get(), "1.2")
+}
+
+func TestStaticLoginRedirect(t *testing.T) {
+	fsys := fstest.MapFS{
+		"index.html": {Data: []byte("<html>app</html>")},
+		"main.js":    {Data: []byte("js")},
+	}
+	router := httprouter.New()
+	loggedIn := func(r *http.Request) bool { return r.Header.Get("Cookie") != "" }
+	HandleStaticFilesFS(router, "/app", fsys, StaticLoginRedirect("/login", loggedIn))
+
+	get := func(path, fetchMode, cookie string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Sec-Fetch-Mode", fetchMode)
+		r.Header.Set("Cookie", cookie)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	w := get("/app/assets?id=3", "navigate", "")
+	assert.Equal(t, w.Code, http.StatusFound)
+	assert.Equal(t, w.Header().Get("Location"), "/login?redirect=%2Fapp%2Fassets%3Fid%3D3")
+	assert.Equal(t, get("/app/assets", "navigate", "session=1").Code, 200)
+	assert.Equal(t, get("/app/assets", "cors", "").Code, 200)
+	assert.Equal(t, get("/app/static/main.js", "no-cors", "").Code, 200)
+}
+
+func TestStaticDevProxy(t *testing.T) {
+	dev := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") == "websocket" {
+			w.Header().Set("Connection", "Upgrade")
+			w.Header().Set("Upgrade", "websocket")
+			w.WriteHeader(http.StatusSwitchingProtocols)
+			conn, rw, _ := http.NewResponseController(w).Hijack()
+			defer conn.Close()
+			line, _ := rw.ReadString('\n')
+			rw.WriteString("echo " + line)
+			rw.Flush()
+			return
+		}
+		w.Write([]byte("dev " + r.URL.Path))
+	}))
+	defer dev.Close()
+
+	router := httprouter.New()
+	HandleStaticFiles(router, "/app", StaticDevProxy(dev.URL))
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get(server.URL + path)
+		assert.NilError(t, err)
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	code, body := get("/app/static/main.js")
+	assert.Equal(t, code, 200)
+	assert.Equal(t, body, "dev /app/static/main.js")
+	_, body = get("/app/@vite/client")
+	assert.Equal(t, body, "dev /app/@vite/client")
+	code, _ = get("/app/api/nope")
+	assert.Equal(t, code, 404)
+
+	req, _ := http.NewRequest("GET", server.URL+"/app/", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NilError(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusSwitchingProtocols)
+	conn := resp.Body.(io.ReadWriteCloser)
+	defer conn.Close()
+	conn.Write([]byte("hello\n"))
+	reply, _ := bufio.NewReader(conn).ReadString('\n')
+	assert.Equal(t, reply, "echo hello\n")
+}
+
+func TestStaticMounts(t *testing.T) {
+	router := httprouter.New()
+	router.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { http.Error(w, "nobody here", 404) })
+	HandleStaticFilesFS(router, "/app", fstest.MapFS{"index.html": {Data: []byte("app")}},
+		StaticNotFound(nil), StaticAPINotFound(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(404)
+			SendJSON(w, map[string]string{"error": "no such API"})
+		})))
+	HandleStaticFilesFS(router, "/app/admin", fstest.MapFS{"index.html": {Data: []byte("admin")}})
+
+	get := func(path string) (int, string) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code, w.Body.String()
+	}
+	check := func(path string, code int, body string) {
+		t.Helper()
+		c, b := get(path)
+		assert.Equal(t, c, code)
+		assert.Equal(t, b, body)
+	}
+	check("/app/assets", 200, "app")
+	check("/app/admin/users", 200, "admin")
+	check("/app/main.js", 404, "404 page not found\n")
+	check("/app/static/missing.css", 404, "404 page not found\n")
+	check("/app/admin/main.js", 200, "admin")
+	check("/app/api/nope", 404, `{"error":"no such API"}`)
+	check("/application", 404, "nobody here\n")
+}
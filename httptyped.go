@@ -0,0 +1,60 @@
+package nf
+
+import (
+	"net/http"
+	"reflect"
+
+	"github.com/IMQS/serviceauth"
+	"github.com/julienschmidt/httprouter"
+)
+
+// NoBody is used as the request or response type of a typed handler, when there is no body.
+// A typed handler with a NoBody response sends 204 No Content.
+type NoBody struct{}
+
+// HandleJSON is a typed variant of Handle. The request body is decoded from JSON into a new Req, and the
+// value returned by handle is sent as JSON. Because the types are known, they are included in the OpenAPI document.
+func HandleJSON[Req, Resp any](router *httprouter.Router, method, path string, handle func(r *http.Request, p httprouter.Params, req *Req) Resp, opts ...RouteOption) {
+	opts = append(typedRouteOptions[Req, Resp](), opts...)
+	Handle(router, method, path, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		sendTyped(w, handle(r, p, readTyped[Req](r)))
+	}, opts...)
+}
+
+// HandleAuthenticatedJSON is a typed variant of HandleAuthenticated. See HandleJSON.
+func HandleAuthenticatedJSON[Req, Resp any](router *httprouter.Router, method, path string, handle func(r *http.Request, p httprouter.Params, auth *serviceauth.Token, req *Req) Resp, needPermissions []int, opts ...RouteOption) {
+	opts = append(typedRouteOptions[Req, Resp](), opts...)
+	HandleAuthenticated(router, method, path, func(w http.ResponseWriter, r *http.Request, p httprouter.Params, auth *serviceauth.Token) {
+		sendTyped(w, handle(r, p, auth, readTyped[Req](r)))
+	}, needPermissions, opts...)
+}
+
+func typedRouteOptions[Req, Resp any]() []RouteOption {
+	noBody := reflect.TypeOf(NoBody{})
+	reqType := reflect.TypeOf((*Req)(nil)).Elem()
+	respType := reflect.TypeOf((*Resp)(nil)).Elem()
+	return []RouteOption{func(r *Route) {
+		if reqType != noBody {
+			r.RequestType = reqType
+		}
+		if respType != noBody {
+			r.ResponseType = respType
+		}
+	}}
+}
+
+func readTyped[Req any](r *http.Request) *Req {
+	req := new(Req)
+	if _, isNoBody := interface{}(req).(*NoBody); !isNoBody {
+		ReadJSON(r, req)
+	}
+	return req
+}
+
+func sendTyped(w http.ResponseWriter, resp interface{}) {
+	if _, isNoBody := resp.(NoBody); isNoBody {
+		SendNoContent(w)
+	} else {
+		SendJSON(w, resp)
+	}
+}
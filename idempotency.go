@@ -0,0 +1,223 @@
+package nf
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	stdlog "log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/IMQS/log"
+	"github.com/IMQS/nf/nfidempotency"
+	"github.com/IMQS/serviceauth"
+)
+
+// DefaultIdempotencyExpiry is how long an Idempotency-Key is remembered, if the Idempotent option is given an expiry of zero.
+var DefaultIdempotencyExpiry = 24 * time.Hour
+
+// MaxIdempotentRequestSize limits the size of the body of a request with an Idempotency-Key, because the body must be read
+// into memory to compute its fingerprint.
+var MaxIdempotentRequestSize int64 = 10 * 1024 * 1024
+
+// MaxIdempotentResponseSize limits the size of a response that is stored for replay. A larger response is sent as usual,
+// but it is not stored, so a retry will run the handler again.
+var MaxIdempotentResponseSize = 1024 * 1024
+
+// IdempotentResponse is the stored outcome of a request with an Idempotency-Key.
+type IdempotentResponse = nfidempotency.Response
+
+// IdempotencyStore persists Idempotency-Keys and their responses. nfdb.IdempotencyStore stores them in the database,
+// which is what you want if your service has more than one instance.
+type IdempotencyStore = nfidempotency.Store
+
+// ErrorLog receives errors that nf cannot send to the client, such as a failure to store the response of an
+// idempotent request. If nil, then they are written to the standard library's logger.
+var ErrorLog *log.Logger
+
+func logErrorf(format string, args ...interface{}) {
+	if ErrorLog != nil {
+		ErrorLog.Errorf(format, args...)
+	} else {
+		stdlog.Printf(format, args...)
+	}
+}
+
+// Idempotent makes a route honour the Idempotency-Key request header, so that a client can safely retry a POST after
+// a network failure, without creating a duplicate record. The first request with a given key runs as usual, and its
+// response is stored. A retry with the same key and the same body receives the stored response, with the header
+// Idempotent-Replayed: true. Reusing a key with a different body is rejected with 422, and a retry that arrives while
+// the first request is still running is rejected with 409.
+// Server errors (5xx) and panics are not stored, so those requests can be retried.
+// Keys are scoped to the route and the user, and are forgotten after expiry (DefaultIdempotencyExpiry if zero).
+// Requests without an Idempotency-Key are not affected.
+func Idempotent(store IdempotencyStore, expiry time.Duration) RouteOption {
+	return func(r *Route) {
+		r.idempotency = store
+		r.idempotencyExpiry = expiry
+	}
+}
+
+func (route *Route) serveIdempotent(w http.ResponseWriter, r *http.Request, auth *serviceauth.Token, key string, handler func(w http.ResponseWriter)) interface{} {
+	if len(key) > 255 {
+		http.Error(w, "Idempotency-Key is too long", http.StatusBadRequest)
+		return nil
+	}
+	body := []byte{}
+	if r.Body != nil {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(r.Body, MaxIdempotentRequestSize+1))
+		r.Body.Close()
+		if err != nil {
+			http.Error(w, "Failed to read request body: "+err.Error(), http.StatusBadRequest)
+			return nil
+		}
+		if int64(len(body)) > MaxIdempotentRequestSize {
+			http.Error(w, "Request body is too large", http.StatusRequestEntityTooLarge)
+			return nil
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	hash := sha256.New()
+	io.WriteString(hash, r.Method+" "+r.URL.RequestURI()+"\n")
+	hash.Write(body)
+	fingerprint := hex.EncodeToString(hash.Sum(nil))
+
+	scope := "anonymous"
+	if auth != nil {
+		scope = "user:" + strconv.FormatInt(int64(auth.UserId), 10)
+	}
+	storeKey := route.Method + " " + route.Path + " " + scope + " " + key
+	expiry := route.idempotencyExpiry
+	if expiry == 0 {
+		expiry = DefaultIdempotencyExpiry
+	}
+
+	reservation, existing, err := route.idempotency.Begin(r.Context(), storeKey, fingerprint, time.Now().Add(expiry))
+	if err != nil {
+		http.Error(w, "Failed to check Idempotency-Key: "+err.Error(), http.StatusServiceUnavailable)
+		return nil
+	}
+	if existing != nil {
+		switch {
+		case existing.Fingerprint != fingerprint:
+			http.Error(w, "Idempotency-Key has already been used for a different request", http.StatusUnprocessableEntity)
+		case !existing.Completed:
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "A request with this Idempotency-Key is still being processed", http.StatusConflict)
+		default:
+			for k, v := range existing.Header {
+				w.Header()[k] = v
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(existing.Status)
+			w.Write(existing.Body)
+		}
+		return nil
+	}
+
+	rw := &recordingWriter{ResponseWriter: w}
+	rec := runProtected(rw, r, func() { handler(rw) })
+
+	status := rw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	store := route.idempotency
+	if rec != nil || status >= 500 || rw.overflow {
+		finishIdempotent(r.Context(), "release", storeKey, func(ctx context.Context) error {
+			return store.Release(ctx, storeKey, reservation)
+		})
+	} else {
+		response := &IdempotentResponse{
+			Fingerprint: fingerprint,
+			Completed:   true,
+			Status:      status,
+			Header:      rw.header,
+			Body:        rw.body.Bytes(),
+		}
+		finishIdempotent(r.Context(), "store the response of", storeKey, func(ctx context.Context) error {
+			return store.Complete(ctx, storeKey, reservation, response)
+		})
+	}
+	return rec
+}
+
+// idempotentRetries are the waits between the background retries of finishIdempotent
+var idempotentRetries = []time.Duration{time.Second, 5 * time.Second, 30 * time.Second}
+
+// finishIdempotent runs fn, which completes or releases a key. If that fails, then fn is retried in the background,
+// because otherwise the key stays "in progress", and every retry of the request receives 409 until the store
+// considers it stale.
+func finishIdempotent(requestCtx context.Context, action, key string, fn func(ctx context.Context) error) {
+	// The client may have gone away, but we still need to record the outcome
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(requestCtx), 10*time.Second)
+	err := fn(ctx)
+	cancel()
+	if err == nil {
+		return
+	}
+	logErrorf("Failed to %v Idempotency-Key %v (will retry): %v", action, key, err)
+	go func() {
+		for _, wait := range idempotentRetries {
+			time.Sleep(wait)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			err = fn(ctx)
+			cancel()
+			if err == nil {
+				return
+			}
+		}
+		logErrorf("Failed to %v Idempotency-Key %v, giving up: %v", action, key, err)
+	}()
+}
+
+// recordingWriter keeps a copy of the response, so that it can be replayed
+type recordingWriter struct {
+	http.ResponseWriter
+	status   int
+	header   http.Header
+	body     bytes.Buffer
+	overflow bool // True if the body was too large to store
+}
+
+func (rw *recordingWriter) WriteHeader(code int) {
+	if rw.status == 0 {
+		rw.status = code
+		rw.header = rw.Header().Clone()
+		// These are specific to the original response
+		for _, h := range []string{"Date", "Set-Cookie", "Content-Security-Policy", "Content-Security-Policy-Report-Only"} {
+			rw.header.Del(h)
+		}
+	}
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *recordingWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if !rw.overflow {
+		if rw.body.Len()+len(b) > MaxIdempotentResponseSize {
+			rw.overflow = true
+			rw.body = bytes.Buffer{}
+		} else {
+			rw.body.Write(b)
+		}
+	}
+	return rw.ResponseWriter.Write(b)
+}
+
+func (rw *recordingWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap allows http.ResponseController to reach the original writer
+func (rw *recordingWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
@@ -0,0 +1,153 @@
+package nf
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	stdlog "log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"gotest.tools/v3/assert"
+)
+
+type memoryIdempotencyStore struct {
+	lock         sync.Mutex
+	keys         map[string]*IdempotentResponse
+	reservations map[string]string
+	last         int
+}
+
+func newMemoryIdempotencyStore() *memoryIdempotencyStore {
+	return &memoryIdempotencyStore{keys: map[string]*IdempotentResponse{}, reservations: map[string]string{}}
+}
+
+func (m *memoryIdempotencyStore) Begin(ctx context.Context, key, fingerprint string, expires time.Time) (string, *IdempotentResponse, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if existing := m.keys[key]; existing != nil {
+		return "", existing, nil
+	}
+	m.last++
+	m.keys[key] = &IdempotentResponse{Fingerprint: fingerprint}
+	m.reservations[key] = strconv.Itoa(m.last)
+	return m.reservations[key], nil, nil
+}
+
+func (m *memoryIdempotencyStore) Complete(ctx context.Context, key, reservation string, response *IdempotentResponse) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.reservations[key] == reservation {
+		m.keys[key] = response
+	}
+	return nil
+}
+
+func (m *memoryIdempotencyStore) Release(ctx context.Context, key, reservation string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.reservations[key] == reservation && !m.keys[key].Completed {
+		delete(m.keys, key)
+		delete(m.reservations, key)
+	}
+	return nil
+}
+
+func TestIdempotent(t *testing.T) {
+	store := newMemoryIdempotencyStore()
+	created := 0
+	router := httprouter.New()
+	Handle(router, "POST", "/assets", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		var asset struct{ Name string }
+		ReadJSON(r, &asset)
+		if asset.Name == "fail" {
+			PanicServerError("database is down")
+		}
+		created++
+		w.WriteHeader(http.StatusCreated)
+		SendID(w, created)
+	}, Idempotent(store, time.Hour))
+
+	post := func(key, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/assets", strings.NewReader(body))
+		if key != "" {
+			r.Header.Set("Idempotency-Key", key)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	w := post("k1", `{"Name": "pump"}`)
+	assert.Equal(t, w.Code, http.StatusCreated)
+	assert.Equal(t, w.Body.String(), "1")
+
+	w = post("k1", `{"Name": "pump"}`)
+	assert.Equal(t, w.Code, http.StatusCreated)
+	assert.Equal(t, w.Body.String(), "1")
+	assert.Equal(t, w.Header().Get("Idempotent-Replayed"), "true")
+	assert.Equal(t, created, 1)
+
+	assert.Equal(t, post("k1", `{"Name": "valve"}`).Code, http.StatusUnprocessableEntity)
+	assert.Equal(t, post("", `{"Name": "pump"}`).Body.String(), "2")
+
+	// Server errors are not stored, so the client can retry
+	assert.Equal(t, post("k2", `{"Name": "fail"}`).Code, 500)
+	assert.Equal(t, len(store.keys), 1)
+}
+
+// flakyIdempotencyStore fails the first Complete
+type flakyIdempotencyStore struct {
+	*memoryIdempotencyStore
+	failed bool
+}
+
+func (f *flakyIdempotencyStore) Complete(ctx context.Context, key, reservation string, response *IdempotentResponse) error {
+	f.lock.Lock()
+	failed := f.failed
+	f.failed = true
+	f.lock.Unlock()
+	if !failed {
+		return errors.New("database is down")
+	}
+	return f.memoryIdempotencyStore.Complete(ctx, key, reservation, response)
+}
+
+func TestIdempotentStoreFailure(t *testing.T) {
+	defer func(r []time.Duration) { idempotentRetries = r }(idempotentRetries)
+	idempotentRetries = []time.Duration{time.Millisecond}
+	logged := &bytes.Buffer{}
+	stdlog.SetOutput(logged)
+	defer stdlog.SetOutput(os.Stderr)
+
+	store := &flakyIdempotencyStore{memoryIdempotencyStore: newMemoryIdempotencyStore()}
+	router := httprouter.New()
+	Handle(router, "POST", "/flaky", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		SendOK(w)
+	}, Idempotent(store, time.Hour))
+	r := httptest.NewRequest("POST", "/flaky", strings.NewReader("{}"))
+	r.Header.Set("Idempotency-Key", "k")
+	router.ServeHTTP(httptest.NewRecorder(), r)
+
+	// The failure is logged, and the response is stored by a retry in the background
+	for i := 0; i < 100; i++ {
+		store.lock.Lock()
+		completed := len(store.keys) == 1 && store.keys["POST /flaky anonymous k"].Completed
+		store.lock.Unlock()
+		if completed {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	store.lock.Lock()
+	assert.Assert(t, store.keys["POST /flaky anonymous k"].Completed)
+	store.lock.Unlock()
+	assert.Assert(t, strings.Contains(logged.String(), "Failed to store the response of Idempotency-Key POST /flaky anonymous k (will retry): database is down"), logged.String())
+}
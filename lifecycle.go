@@ -0,0 +1,328 @@
+package nf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IMQS/log"
+)
+
+// DefaultComponentTimeout is used when Component.StartTimeout or Component.StopTimeout is zero.
+var DefaultComponentTimeout = 30 * time.Second
+
+// Component states, as reported by Lifecycle.Status
+const (
+	ComponentPending  = "pending"
+	ComponentStarting = "starting"
+	ComponentRunning  = "running"
+	ComponentFailed   = "failed"
+	ComponentStopping = "stopping"
+	ComponentStopped  = "stopped"
+)
+
+// Component is a part of a service that needs to be started and stopped, such as a DB connection,
+// a cache, or a background worker.
+//
+// The ctx that is passed to Start stays alive while the component is running, so a background worker may run on it.
+// It is cancelled just before Stop is called, or if Start fails or times out. StartTimeout only limits how long we
+// wait for Start to return.
+type Component struct {
+	Name         string
+	DependsOn    []string                        // Names of components that must be running before this one is started
+	Start        func(ctx context.Context) error // Required. See below for ctx.
+	Stop         func(ctx context.Context) error // Optional
+	StartTimeout time.Duration                   // If zero, then DefaultComponentTimeout
+	StopTimeout  time.Duration                   // If zero, then DefaultComponentTimeout
+}
+
+// ComponentStatus is the state of a single component.
+type ComponentStatus struct {
+	Name  string
+	State string
+	Error string `json:",omitempty"`
+}
+
+// Lifecycle starts components in dependency order, and stops them in the reverse order.
+//
+// Typical usage from main():
+//
+//	lc := nf.NewLifecycle(log)
+//	lc.Add(nf.Component{Name: "db", Start: openDB, Stop: closeDB})
+//	lc.Add(nf.Component{Name: "worker", DependsOn: []string{"db"}, Start: startWorker, Stop: stopWorker})
+//	if err := lc.Start(context.Background()); err != nil {
+//		log.Errorf("%v", err)
+//		return
+//	}
+//	nf.DefaultHealth.Add(nf.HealthCheck{Name: "components", Check: lc.Check})
+//	server.AddShutdownHook("components", lc.Stop)
+//	server.Run()
+//
+// RunServer does all of the above, except for the health check.
+type Lifecycle struct {
+	Log *log.Logger // Optional
+
+	lock       sync.Mutex
+	components []*componentState
+	started    []*componentState // In the order in which they were started
+}
+
+type componentState struct {
+	Component
+	state  string
+	err    error
+	cancel context.CancelFunc // Cancels the context that was passed to Start
+}
+
+// NewLifecycle creates an empty lifecycle manager. log may be nil.
+func NewLifecycle(log *log.Logger) *Lifecycle {
+	return &Lifecycle{
+		Log: log,
+	}
+}
+
+// Add registers a component. Components must be added before Start is called.
+func (l *Lifecycle) Add(c Component) {
+	if c.Name == "" || c.Start == nil {
+		panic("Component must have a Name and a Start function")
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, existing := range l.components {
+		if existing.Name == c.Name {
+			panic(fmt.Sprintf("Component %v has already been added", c.Name))
+		}
+	}
+	l.components = append(l.components, &componentState{Component: c, state: ComponentPending})
+}
+
+// Start starts all components in dependency order. If any component fails to start, then the components
+// that have already been started are stopped (in reverse order), and an error is returned that names
+// the component which failed. A component whose Start times out, but then does finish starting, is stopped
+// as soon as it finishes.
+func (l *Lifecycle) Start(ctx context.Context) error {
+	order, err := l.startOrder()
+	if err != nil {
+		return err
+	}
+	for _, c := range order {
+		l.setState(c, ComponentStarting, nil)
+		l.infof("Starting %v", c.Name)
+		start := time.Now()
+		// The component's context outlives Start, but not the component
+		runCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		c.cancel = cancel
+		timeout := timeoutOrDefault(c.StartTimeout, DefaultComponentTimeout)
+		waitCtx, stopWaiting := context.WithTimeout(ctx, timeout)
+		late, err := waitFor(waitCtx, timeout, func() error { return c.Start(runCtx) })
+		stopWaiting()
+		if err != nil {
+			cancel()
+			if late != nil && c.Stop != nil {
+				go l.stopLate(c, late)
+			}
+			err = fmt.Errorf("Failed to start %v: %w", c.Name, err)
+			l.setState(c, ComponentFailed, err)
+			l.errorf("%v", err)
+			if stopErr := l.Stop(ctx); stopErr != nil {
+				err = errors.Join(err, stopErr)
+			}
+			return err
+		}
+		l.setState(c, ComponentRunning, nil)
+		l.infof("Started %v in %v", c.Name, time.Since(start).Round(time.Millisecond))
+		l.lock.Lock()
+		l.started = append(l.started, c)
+		l.lock.Unlock()
+	}
+	return nil
+}
+
+// Stop stops all running components, in the reverse order in which they were started.
+// A component that fails to stop does not prevent the others from being stopped.
+func (l *Lifecycle) Stop(ctx context.Context) error {
+	l.lock.Lock()
+	started := l.started
+	l.started = nil
+	l.lock.Unlock()
+
+	errs := []error{}
+	for i := len(started) - 1; i >= 0; i-- {
+		c := started[i]
+		c.cancel()
+		if c.Stop == nil {
+			l.setState(c, ComponentStopped, nil)
+			continue
+		}
+		l.setState(c, ComponentStopping, nil)
+		l.infof("Stopping %v", c.Name)
+		if _, err := callWithTimeout(ctx, timeoutOrDefault(c.StopTimeout, DefaultComponentTimeout), c.Stop); err != nil {
+			err = fmt.Errorf("Failed to stop %v: %w", c.Name, err)
+			l.errorf("%v", err)
+			l.setState(c, ComponentFailed, err)
+			errs = append(errs, err)
+			continue
+		}
+		l.setState(c, ComponentStopped, nil)
+	}
+	return errors.Join(errs...)
+}
+
+// stopLate waits for a component whose Start timed out, and stops it if it does finish starting,
+// so that it isn't left running without anybody knowing about it.
+func (l *Lifecycle) stopLate(c *componentState, late <-chan error) {
+	if err := <-late; err != nil {
+		return
+	}
+	l.infof("%v finished starting after it timed out, so stopping it", c.Name)
+	if _, err := callWithTimeout(context.Background(), timeoutOrDefault(c.StopTimeout, DefaultComponentTimeout), c.Stop); err != nil {
+		l.errorf("Failed to stop %v: %v", c.Name, err)
+	}
+}
+
+// RunServer starts all components, and then runs server until it is told to stop (see Server.Run).
+// The components are stopped after the server's in-flight requests have finished.
+func (l *Lifecycle) RunServer(server *Server) error {
+	if err := l.Start(context.Background()); err != nil {
+		return err
+	}
+	server.AddShutdownHook("components", l.Stop)
+	return server.Run()
+}
+
+// Status returns the state of all components, in the order in which they were added.
+func (l *Lifecycle) Status() []ComponentStatus {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	status := []ComponentStatus{}
+	for _, c := range l.components {
+		s := ComponentStatus{Name: c.Name, State: c.state}
+		if c.err != nil {
+			s.Error = c.err.Error()
+		}
+		status = append(status, s)
+	}
+	return status
+}
+
+// Check returns an error if any component is not running.
+// This has the signature of HealthCheck.Check, so that it can be used as a readiness check.
+func (l *Lifecycle) Check(ctx context.Context) error {
+	bad := []string{}
+	for _, s := range l.Status() {
+		if s.State != ComponentRunning {
+			bad = append(bad, s.Name+" is "+s.State)
+		}
+	}
+	if len(bad) != 0 {
+		return errors.New(strings.Join(bad, ", "))
+	}
+	return nil
+}
+
+// startOrder returns the components sorted so that every component comes after its dependencies.
+// Components without dependencies between them keep the order in which they were added.
+func (l *Lifecycle) startOrder() ([]*componentState, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	byName := map[string]*componentState{}
+	for _, c := range l.components {
+		byName[c.Name] = c
+	}
+	for _, c := range l.components {
+		for _, dep := range c.DependsOn {
+			if byName[dep] == nil {
+				return nil, fmt.Errorf("Component %v depends on %v, which does not exist", c.Name, dep)
+			}
+		}
+	}
+
+	order := []*componentState{}
+	done := map[string]bool{}
+	visiting := map[string]bool{}
+	var visit func(c *componentState, path []string) error
+	visit = func(c *componentState, path []string) error {
+		if done[c.Name] {
+			return nil
+		}
+		path = append(path, c.Name)
+		if visiting[c.Name] {
+			return fmt.Errorf("Component dependency cycle: %v", strings.Join(path, " -> "))
+		}
+		visiting[c.Name] = true
+		for _, dep := range c.DependsOn {
+			if err := visit(byName[dep], path); err != nil {
+				return err
+			}
+		}
+		done[c.Name] = true
+		order = append(order, c)
+		return nil
+	}
+	for _, c := range l.components {
+		if err := visit(c, nil); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+func (l *Lifecycle) setState(c *componentState, state string, err error) {
+	l.lock.Lock()
+	c.state = state
+	c.err = err
+	l.lock.Unlock()
+}
+
+func (l *Lifecycle) infof(format string, args ...interface{}) {
+	if l.Log != nil {
+		l.Log.Infof(format, args...)
+	}
+}
+
+func (l *Lifecycle) errorf(format string, args ...interface{}) {
+	if l.Log != nil {
+		l.Log.Errorf(format, args...)
+	}
+}
+
+func timeoutOrDefault(timeout, def time.Duration) time.Duration {
+	if timeout == 0 {
+		return def
+	}
+	return timeout
+}
+
+// callWithTimeout runs fn with a context that expires after timeout (see waitFor).
+func callWithTimeout(ctx context.Context, timeout time.Duration, fn func(ctx context.Context) error) (late <-chan error, err error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return waitFor(ctx, timeout, func() error { return fn(ctx) })
+}
+
+// waitFor runs fn, and waits for it until ctx is done, which is expected to be after timeout. fn runs on a separate
+// goroutine, so that a function which ignores its context cannot block the caller beyond that. A panic inside fn is
+// returned as an error. If we stop waiting for fn, then late delivers its eventual result.
+func waitFor(ctx context.Context, timeout time.Duration, fn func() error) (late <-chan error, err error) {
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if rec := recover(); rec != nil {
+				done <- fmt.Errorf("panic: %v", rec)
+			}
+		}()
+		done <- fn()
+	}()
+	select {
+	case err := <-done:
+		return nil, err
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return done, fmt.Errorf("timed out after %v", timeout)
+		}
+		return done, ctx.Err()
+	}
+}
@@ -0,0 +1,107 @@
+package nf
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestLifecycle(t *testing.T) {
+	events := []string{}
+	component := func(name string, fail bool, deps ...string) Component {
+		return Component{
+			Name:      name,
+			DependsOn: deps,
+			Start: func(ctx context.Context) error {
+				if fail {
+					return errors.New("boom")
+				}
+				events = append(events, "start "+name)
+				return nil
+			},
+			Stop: func(ctx context.Context) error {
+				events = append(events, "stop "+name)
+				return nil
+			},
+		}
+	}
+
+	lc := NewLifecycle(nil)
+	lc.Add(component("worker", false, "db", "cache"))
+	lc.Add(component("cache", false, "db"))
+	lc.Add(component("db", false))
+	assert.NilError(t, lc.Start(context.Background()))
+	assert.NilError(t, lc.Check(context.Background()))
+	assert.NilError(t, lc.Stop(context.Background()))
+	assert.DeepEqual(t, events, []string{"start db", "start cache", "start worker", "stop worker", "stop cache", "stop db"})
+	assert.ErrorContains(t, lc.Check(context.Background()), "db is stopped")
+
+	// A failure must stop everything that has already started
+	events = nil
+	lc = NewLifecycle(nil)
+	lc.Add(component("db", false))
+	lc.Add(component("worker", true, "db"))
+	assert.ErrorContains(t, lc.Start(context.Background()), "Failed to start worker: boom")
+	assert.DeepEqual(t, events, []string{"start db", "stop db"})
+
+	lc = NewLifecycle(nil)
+	lc.Add(component("a", false, "b"))
+	lc.Add(component("b", false, "a"))
+	assert.ErrorContains(t, lc.Start(context.Background()), "cycle: a -> b -> a")
+}
+
+func TestLifecycleLateStart(t *testing.T) {
+	stopped := make(chan struct{})
+	lc := NewLifecycle(nil)
+	lc.Add(Component{
+		Name:         "slow",
+		StartTimeout: 10 * time.Millisecond,
+		Start: func(ctx context.Context) error {
+			// Ignores its context, and finishes starting after the timeout
+			time.Sleep(50 * time.Millisecond)
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			close(stopped)
+			return nil
+		},
+	})
+	assert.ErrorContains(t, lc.Start(context.Background()), "Failed to start slow: timed out")
+
+	// Once it has finished starting, it is stopped, instead of being left running
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Component was not stopped after it finished starting")
+	}
+}
+
+func TestLifecycleContext(t *testing.T) {
+	var startCtx context.Context
+	stopped := make(chan bool, 1)
+	lc := NewLifecycle(nil)
+	lc.Add(Component{
+		Name:         "worker",
+		StartTimeout: 10 * time.Millisecond,
+		Start: func(ctx context.Context) error {
+			startCtx = ctx
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			stopped <- startCtx.Err() != nil
+			return nil
+		},
+	})
+	assert.NilError(t, lc.Start(context.Background()))
+
+	// A background worker may keep running on the context of Start, even beyond StartTimeout
+	time.Sleep(20 * time.Millisecond)
+	assert.NilError(t, startCtx.Err())
+
+	// The context is cancelled before Stop is called
+	assert.NilError(t, lc.Stop(context.Background()))
+	assert.Assert(t, <-stopped)
+}
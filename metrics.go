@@ -0,0 +1,488 @@
+package nf
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// DefaultLatencyBuckets are the histogram buckets (in seconds) used for request latency.
+var DefaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// DefaultMetrics is the registry that the Handle wrappers record their statistics into, and which
+// is served by HandleMetrics.
+var DefaultMetrics = NewMetrics()
+
+// Metrics is a registry of counters, gauges and histograms, which can be written out in
+// the Prometheus text exposition format.
+// See https://prometheus.io/docs/instrumenting/exposition_formats/
+type Metrics struct {
+	lock       sync.Mutex
+	families   map[string]*metricFamily
+	collectors []func(w io.Writer)
+	dbs        []namedDB // Added by AddDB
+}
+
+type namedDB struct {
+	name string
+	db   *sql.DB
+}
+
+type metricFamily struct {
+	name       string
+	help       string
+	kind       string // counter, gauge, histogram
+	labelNames []string
+	buckets    []float64
+	series     map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labelValues []string
+	value       float64  // counter and gauge
+	counts      []uint64 // histogram (not cumulative)
+	sum         float64  // histogram
+	count       uint64   // histogram
+}
+
+// Counter is a monotonically increasing value, optionally partitioned by labels.
+type Counter struct {
+	m *Metrics
+	f *metricFamily
+}
+
+// Gauge is a value that can go up and down, optionally partitioned by labels.
+type Gauge struct {
+	m *Metrics
+	f *metricFamily
+}
+
+// Histogram counts observations into buckets, optionally partitioned by labels.
+type Histogram struct {
+	m *Metrics
+	f *metricFamily
+}
+
+// NewMetrics creates a new registry, which already includes the Go runtime statistics.
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		families: map[string]*metricFamily{},
+	}
+	m.addCollector(writeRuntimeMetrics)
+	return m
+}
+
+// NewCounter registers a new counter. If a counter with the same name already exists, then it is returned.
+func (m *Metrics) NewCounter(name, help string, labelNames ...string) *Counter {
+	return &Counter{m, m.family(name, help, "counter", labelNames, nil)}
+}
+
+// NewGauge registers a new gauge. If a gauge with the same name already exists, then it is returned.
+func (m *Metrics) NewGauge(name, help string, labelNames ...string) *Gauge {
+	return &Gauge{m, m.family(name, help, "gauge", labelNames, nil)}
+}
+
+// NewHistogram registers a new histogram. If buckets is nil, then DefaultLatencyBuckets is used.
+// If a histogram with the same name already exists, then it is returned.
+func (m *Metrics) NewHistogram(name, help string, buckets []float64, labelNames ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultLatencyBuckets
+	}
+	b := append([]float64{}, buckets...)
+	sort.Float64s(b)
+	return &Histogram{m, m.family(name, help, "histogram", labelNames, b)}
+}
+
+// AddDB publishes the connection pool statistics of db, under the label db=name.
+// If you're using GORM, then pass in gormDB.DB().
+func (m *Metrics) AddDB(name string, db *sql.DB) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if len(m.dbs) == 0 {
+		// A single collector for all DBs, so that each family is written as one block
+		m.collectors = append(m.collectors, m.writeDBMetrics)
+	}
+	m.dbs = append(m.dbs, namedDB{name, db})
+}
+
+// Inc adds 1 to the counter.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v to the counter. v must not be negative.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic(fmt.Sprintf("Counter %v may not decrease", c.f.name))
+	}
+	c.m.lock.Lock()
+	c.f.get(labelValues).value += v
+	c.m.lock.Unlock()
+}
+
+// Set sets the value of the gauge.
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.m.lock.Lock()
+	g.f.get(labelValues).value = v
+	g.m.lock.Unlock()
+}
+
+// Add adds v (which may be negative) to the gauge.
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.m.lock.Lock()
+	g.f.get(labelValues).value += v
+	g.m.lock.Unlock()
+}
+
+// Inc adds 1 to the gauge.
+func (g *Gauge) Inc(labelValues ...string) {
+	g.Add(1, labelValues...)
+}
+
+// Dec subtracts 1 from the gauge.
+func (g *Gauge) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+// Observe adds a single observation to the histogram.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.m.lock.Lock()
+	s := h.f.get(labelValues)
+	for i, upper := range h.f.buckets {
+		if v <= upper {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += v
+	s.count++
+	h.m.lock.Unlock()
+}
+
+// WriteText writes all metrics in the Prometheus text format.
+func (m *Metrics) WriteText(w io.Writer) {
+	// Render into a buffer, so that we don't hold the lock while waiting on the network
+	buf := bytes.Buffer{}
+	m.lock.Lock()
+	names := make([]string, 0, len(m.families))
+	for name := range m.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		m.families[name].write(&buf)
+	}
+	collectors := m.collectors
+	m.lock.Unlock()
+
+	for _, c := range collectors {
+		c(&buf)
+	}
+	w.Write(buf.Bytes())
+}
+
+// ServeHTTP sends all metrics in the Prometheus text format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	m.WriteText(w)
+}
+
+// HandleMetrics serves DefaultMetrics at path (typically "/metrics"), in the Prometheus text exposition format.
+func HandleMetrics(router *httprouter.Router, path string) {
+	router.Handle("GET", path, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		DefaultMetrics.ServeHTTP(w, r)
+	})
+}
+
+func (m *Metrics) addCollector(c func(w io.Writer)) {
+	m.lock.Lock()
+	m.collectors = append(m.collectors, c)
+	m.lock.Unlock()
+}
+
+func (m *Metrics) family(name, help, kind string, labelNames []string, buckets []float64) *metricFamily {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if f, ok := m.families[name]; ok {
+		if f.kind != kind || len(f.labelNames) != len(labelNames) {
+			panic(fmt.Sprintf("Metric %v has already been registered with a different type or labels", name))
+		}
+		return f
+	}
+	f := &metricFamily{
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: append([]string{}, labelNames...),
+		buckets:    buckets,
+		series:     map[string]*metricSeries{},
+	}
+	m.families[name] = f
+	return f
+}
+
+// get must be called with the Metrics lock held
+func (f *metricFamily) get(labelValues []string) *metricSeries {
+	if len(labelValues) != len(f.labelNames) {
+		panic(fmt.Sprintf("Metric %v expects %v label values, but got %v", f.name, len(f.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s := f.series[key]
+	if s == nil {
+		s = &metricSeries{
+			labelValues: append([]string{}, labelValues...),
+		}
+		if f.kind == "histogram" {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// write must be called with the Metrics lock held
+func (f *metricFamily) write(w io.Writer) {
+	writeMetricHeader(w, f.name, f.kind, f.help)
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := f.series[k]
+		labels := formatLabels(f.labelNames, s.labelValues)
+		if f.kind != "histogram" {
+			fmt.Fprintf(w, "%v%v %v\n", f.name, labels, formatFloat(s.value))
+			continue
+		}
+		leNames := append(append([]string{}, f.labelNames...), "le")
+		leValues := append(append([]string{}, s.labelValues...), "")
+		cumulative := uint64(0)
+		for i, upper := range f.buckets {
+			cumulative += s.counts[i]
+			leValues[len(leValues)-1] = formatFloat(upper)
+			fmt.Fprintf(w, "%v_bucket%v %v\n", f.name, formatLabels(leNames, leValues), cumulative)
+		}
+		leValues[len(leValues)-1] = "+Inf"
+		fmt.Fprintf(w, "%v_bucket%v %v\n", f.name, formatLabels(leNames, leValues), s.count)
+		fmt.Fprintf(w, "%v_sum%v %v\n", f.name, labels, formatFloat(s.sum))
+		fmt.Fprintf(w, "%v_count%v %v\n", f.name, labels, s.count)
+	}
+}
+
+func writeMetricHeader(w io.Writer, name, kind, help string) {
+	if help != "" {
+		help = strings.ReplaceAll(help, `\`, `\\`)
+		help = strings.ReplaceAll(help, "\n", `\n`)
+		fmt.Fprintf(w, "# HELP %v %v\n", name, help)
+	}
+	fmt.Fprintf(w, "# TYPE %v %v\n", name, kind)
+}
+
+func writeMetric(w io.Writer, name, kind, help, labels string, value float64) {
+	writeMetricHeader(w, name, kind, help)
+	fmt.Fprintf(w, "%v%v %v\n", name, labels, formatFloat(value))
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	s := strings.Builder{}
+	s.WriteRune('{')
+	for i, n := range names {
+		if i != 0 {
+			s.WriteRune(',')
+		}
+		s.WriteString(n)
+		s.WriteString(`="`)
+		for _, r := range values[i] {
+			switch r {
+			case '\\':
+				s.WriteString(`\\`)
+			case '"':
+				s.WriteString(`\"`)
+			case '\n':
+				s.WriteString(`\n`)
+			default:
+				s.WriteRune(r)
+			}
+		}
+		s.WriteRune('"')
+	}
+	s.WriteRune('}')
+	return s.String()
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var processStartTime = time.Now()
+
+func writeRuntimeMetrics(w io.Writer) {
+	ms := runtime.MemStats{}
+	runtime.ReadMemStats(&ms)
+	writeMetric(w, "go_goroutines", "gauge", "Number of goroutines that currently exist.", "", float64(runtime.NumGoroutine()))
+	writeMetric(w, "go_memstats_alloc_bytes", "gauge", "Number of bytes allocated and still in use.", "", float64(ms.Alloc))
+	writeMetric(w, "go_memstats_sys_bytes", "gauge", "Number of bytes obtained from system.", "", float64(ms.Sys))
+	writeMetric(w, "go_memstats_heap_inuse_bytes", "gauge", "Number of heap bytes that are in use.", "", float64(ms.HeapInuse))
+	writeMetric(w, "go_memstats_heap_objects", "gauge", "Number of allocated objects.", "", float64(ms.HeapObjects))
+	writeMetric(w, "go_gc_cycles_total", "counter", "Number of completed GC cycles.", "", float64(ms.NumGC))
+	writeMetric(w, "go_gc_pause_seconds_total", "counter", "Total time spent in GC stop-the-world pauses.", "", float64(ms.PauseTotalNs)/1e9)
+	writeMetric(w, "process_start_time_seconds", "gauge", "Start time of the process since unix epoch in seconds.", "", float64(processStartTime.Unix()))
+}
+
+var dbMetrics = []struct {
+	name  string
+	kind  string
+	help  string
+	value func(st sql.DBStats) float64
+}{
+	{"nf_db_max_open_connections", "gauge", "Maximum number of open connections to the database.", func(st sql.DBStats) float64 { return float64(st.MaxOpenConnections) }},
+	{"nf_db_open_connections", "gauge", "Number of established connections, both in use and idle.", func(st sql.DBStats) float64 { return float64(st.OpenConnections) }},
+	{"nf_db_in_use_connections", "gauge", "Number of connections currently in use.", func(st sql.DBStats) float64 { return float64(st.InUse) }},
+	{"nf_db_idle_connections", "gauge", "Number of idle connections.", func(st sql.DBStats) float64 { return float64(st.Idle) }},
+	{"nf_db_wait_count_total", "counter", "Total number of connections waited for.", func(st sql.DBStats) float64 { return float64(st.WaitCount) }},
+	{"nf_db_wait_duration_seconds_total", "counter", "Total time blocked waiting for a new connection.", func(st sql.DBStats) float64 { return st.WaitDuration.Seconds() }},
+	{"nf_db_max_idle_closed_total", "counter", "Total number of connections closed due to SetMaxIdleConns.", func(st sql.DBStats) float64 { return float64(st.MaxIdleClosed) }},
+	{"nf_db_max_lifetime_closed_total", "counter", "Total number of connections closed due to SetConnMaxLifetime.", func(st sql.DBStats) float64 { return float64(st.MaxLifetimeClosed) }},
+}
+
+func (m *Metrics) writeDBMetrics(w io.Writer) {
+	m.lock.Lock()
+	dbs := append([]namedDB{}, m.dbs...)
+	m.lock.Unlock()
+	stats := make([]sql.DBStats, len(dbs))
+	for i, db := range dbs {
+		stats[i] = db.db.Stats()
+	}
+	for _, metric := range dbMetrics {
+		writeMetricHeader(w, metric.name, metric.kind, metric.help)
+		for i, db := range dbs {
+			fmt.Fprintf(w, "%v%v %v\n", metric.name, formatLabels([]string{"db"}, []string{db.name}), formatFloat(metric.value(stats[i])))
+		}
+	}
+}
+
+// The instruments that are recorded by the Handle wrappers
+var (
+	httpRequests = DefaultMetrics.NewCounter("nf_http_requests_total", "Number of HTTP requests handled, by route and status code.", "method", "route", "code")
+	httpDuration = DefaultMetrics.NewHistogram("nf_http_request_duration_seconds", "Latency of HTTP requests, by route.", nil, "method", "route")
+	httpInFlight = DefaultMetrics.NewGauge("nf_http_requests_in_flight", "Number of HTTP requests currently being served, by route.", "method", "route")
+	httpPanics   = DefaultMetrics.NewCounter("nf_http_panics_total", "Number of handler panics (other than HTTPError), by route.", "method", "route")
+)
+
+// routeStats records the metrics of a single route, which was registered through nf.
+// We label by the route path (eg /api/asset/:id), and not by the request URL, so that the number of series stays bounded.
+type routeStats struct {
+	method string
+	path   string
+
+	inFlight int64 // Only maintained if the route has a MaxInFlight limit
+
+	lock          sync.Mutex
+	hits          int64
+	errors        int64
+	lastError     string
+	lastErrorCode int
+	lastErrorTime time.Time
+}
+
+// begin is called at the start of every request, and returns the writer that the handler must use.
+func (s *routeStats) begin(w http.ResponseWriter) *statusWriter {
+	httpInFlight.Inc(s.method, s.path)
+	return &statusWriter{ResponseWriter: w, start: time.Now()}
+}
+
+// end is called when the request is finished. If the handler panicked, then rec is the recovered value.
+func (s *routeStats) end(sw *statusWriter, rec interface{}) {
+	status := sw.Status()
+	httpInFlight.Dec(s.method, s.path)
+	httpDuration.Observe(time.Since(sw.start).Seconds(), s.method, s.path)
+	httpRequests.Inc(s.method, s.path, strconv.Itoa(status))
+	if _, isHTTPError := rec.(HTTPError); rec != nil && !isHTTPError {
+		// A panic with an HTTPError is a normal way of responding, and not a bug
+		httpPanics.Inc(s.method, s.path)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.hits++
+	if status >= 400 {
+		s.errors++
+		s.lastError = strings.TrimSpace(sw.errorBody.String())
+		s.lastErrorCode = status
+		s.lastErrorTime = time.Now()
+	}
+}
+
+// statusWriter remembers the status code that was sent to the client
+type statusWriter struct {
+	http.ResponseWriter
+	start     time.Time
+	status    int
+	errorBody bytes.Buffer // The first few bytes of the response, if status >= 400
+}
+
+const maxErrorBody = 256
+
+func (s *statusWriter) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusWriter) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	if s.status >= 400 && s.errorBody.Len() < maxErrorBody {
+		s.errorBody.Write(b[:min(len(b), maxErrorBody-s.errorBody.Len())])
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// Flush is needed for streaming responses
+func (s *statusWriter) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		if s.status == 0 {
+			s.status = http.StatusOK
+		}
+		f.Flush()
+	}
+}
+
+// Unwrap allows http.ResponseController to reach the original writer
+func (s *statusWriter) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// Status returns the status code that was sent, or 200 if nothing has been sent yet
+func (s *statusWriter) Status() int {
+	if s.status == 0 {
+		return http.StatusOK
+	}
+	return s.status
+}
@@ -0,0 +1,104 @@
+package nf
+
+import (
+	"bytes"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	_ "github.com/lib/pq"
+	"gotest.tools/v3/assert"
+)
+
+func TestMetricsText(t *testing.T) {
+	m := NewMetrics()
+	c := m.NewCounter("test_total", "A counter.", "kind")
+	c.Inc("a")
+	c.Add(2, `q"uote`)
+	g := m.NewGauge("test_gauge", "")
+	g.Set(5)
+	g.Dec()
+	h := m.NewHistogram("test_seconds", "A histogram.", []float64{1, 0.1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(7)
+
+	buf := bytes.Buffer{}
+	m.WriteText(&buf)
+	out := buf.String()
+	expect := []string{
+		"# HELP test_total A counter.\n# TYPE test_total counter\n",
+		`test_total{kind="a"} 1` + "\n",
+		`test_total{kind="q\"uote"} 2` + "\n",
+		"# TYPE test_gauge gauge\ntest_gauge 4\n",
+		`test_seconds_bucket{le="0.1"} 1` + "\n",
+		`test_seconds_bucket{le="1"} 2` + "\n",
+		`test_seconds_bucket{le="+Inf"} 3` + "\n",
+		"test_seconds_sum 7.55\ntest_seconds_count 3\n",
+		"# TYPE go_goroutines gauge\n",
+	}
+	for _, e := range expect {
+		assert.Assert(t, strings.Contains(out, e), "Expected to find %q in\n%v", e, out)
+	}
+}
+
+func TestMetricsRouteStats(t *testing.T) {
+	router := httprouter.New()
+	Handle(router, "GET", "/metrics-test/:id", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		switch p.ByName("id") {
+		case "bad":
+			PanicBadRequest()
+		case "crash":
+			panic("crash")
+		}
+		SendOK(w)
+	})
+	for _, id := range []string{"1", "2", "bad", "crash"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics-test/"+id, nil))
+	}
+
+	buf := bytes.Buffer{}
+	DefaultMetrics.WriteText(&buf)
+	out := buf.String()
+	expect := []string{
+		`nf_http_requests_total{method="GET",route="/metrics-test/:id",code="200"} 2`,
+		`nf_http_requests_total{method="GET",route="/metrics-test/:id",code="400"} 1`,
+		`nf_http_requests_total{method="GET",route="/metrics-test/:id",code="500"} 1`,
+		// Only the unexpected panic counts, and not the HTTPError
+		`nf_http_panics_total{method="GET",route="/metrics-test/:id"} 1`,
+		`nf_http_requests_in_flight{method="GET",route="/metrics-test/:id"} 0`,
+		`nf_http_request_duration_seconds_count{method="GET",route="/metrics-test/:id"} 4`,
+	}
+	for _, e := range expect {
+		assert.Assert(t, strings.Contains(out, e), "Expected to find %q in\n%v", e, out)
+	}
+}
+
+func TestMetricsDB(t *testing.T) {
+	// sql.Open doesn't connect, so we don't need a database to read the pool statistics
+	db1, err := sql.Open("postgres", "host=localhost dbname=one")
+	assert.NilError(t, err)
+	defer db1.Close()
+	db2, err := sql.Open("postgres", "host=localhost dbname=two")
+	assert.NilError(t, err)
+	defer db2.Close()
+	db2.SetMaxOpenConns(7)
+
+	m := NewMetrics()
+	m.AddDB("one", db1)
+	m.AddDB("two", db2)
+	buf := bytes.Buffer{}
+	m.WriteText(&buf)
+	out := buf.String()
+
+	// Each family must appear once, with a series for every DB
+	assert.Equal(t, strings.Count(out, "# TYPE nf_db_max_open_connections gauge\n"), 1)
+	assert.Equal(t, strings.Count(out, "# TYPE nf_db_wait_count_total counter\n"), 1)
+	expect := "# TYPE nf_db_max_open_connections gauge\n" +
+		`nf_db_max_open_connections{db="one"} 0` + "\n" +
+		`nf_db_max_open_connections{db="two"} 7` + "\n"
+	assert.Assert(t, strings.Contains(out, expect), "Expected to find %q in\n%v", expect, out)
+}
@@ -1,6 +1,7 @@
 package nfdb
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"regexp"
@@ -179,6 +180,31 @@ func OpenDB(log *log.Logger, driver, dsn string, migrations []migration.Migrator
 	return gormOpen(driver, dsn)
 }
 
+// MigrationVersion returns the number of migrations that have been applied to the database.
+func MigrationVersion(ctx context.Context, db *sql.DB) (int, error) {
+	version := 0
+	err := db.QueryRowContext(ctx, "SELECT version FROM migration_version").Scan(&version)
+	return version, err
+}
+
+// CheckMigrations returns an error if the database has not had exactly len(migrations) migrations applied to it.
+// This is intended to be used as a readiness check, for example:
+//
+//	nf.DefaultHealth.Add(nf.HealthCheck{
+//		Name:  "migrations",
+//		Check: func(ctx context.Context) error { return nfdb.CheckMigrations(ctx, db.DB(), migrations) },
+//	})
+func CheckMigrations(ctx context.Context, db *sql.DB, migrations []migration.Migrator) error {
+	version, err := MigrationVersion(ctx, db)
+	if err != nil {
+		return fmt.Errorf("Failed to read migration version: %v", err)
+	}
+	if version != len(migrations) {
+		return fmt.Errorf("Database is at migration %v, but expected %v", version, len(migrations))
+	}
+	return nil
+}
+
 // DropAllTables delete all tables in the given database.
 // If the database does not exist, returns nil.
 // This function is intended to be used by unit tests.
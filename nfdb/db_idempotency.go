@@ -0,0 +1,148 @@
+package nfdb
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/IMQS/nf/nfidempotency"
+	"github.com/jinzhu/gorm"
+)
+
+// IdempotencyStore is an nf.IdempotencyStore (see nfidempotency.Store) that keeps its keys in the table nf_idempotency, which it creates itself.
+// Expired keys are deleted automatically, at most once per hour.
+type IdempotencyStore struct {
+	db *gorm.DB
+
+	// A request that is still in progress after this long is assumed to have died with its process,
+	// and its key may be taken over by a retry. If zero, then 5 minutes.
+	StaleAfter time.Duration
+
+	lock      sync.Mutex
+	lastPurge time.Time
+}
+
+// NewIdempotencyStore creates the nf_idempotency table, if it doesn't exist yet.
+func NewIdempotencyStore(db *gorm.DB) (*IdempotencyStore, error) {
+	err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS nf_idempotency (
+			key TEXT PRIMARY KEY,
+			fingerprint TEXT NOT NULL,
+			reservation TEXT NOT NULL,
+			completed BOOLEAN NOT NULL DEFAULT false,
+			status INT NOT NULL DEFAULT 0,
+			header TEXT,
+			body BYTEA,
+			created_at TIMESTAMPTZ NOT NULL,
+			expires_at TIMESTAMPTZ NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS nf_idempotency_expires_at ON nf_idempotency (expires_at);
+	`).Error
+	if err != nil {
+		return nil, err
+	}
+	return &IdempotencyStore{db: db}, nil
+}
+
+// Begin implements nfidempotency.Store
+func (s *IdempotencyStore) Begin(ctx context.Context, key, fingerprint string, expires time.Time) (string, *nfidempotency.Response, error) {
+	s.purgeOccasionally()
+	staleAfter := s.StaleAfter
+	if staleAfter == 0 {
+		staleAfter = 5 * time.Minute
+	}
+	reservation, err := newReservation()
+	if err != nil {
+		return "", nil, err
+	}
+	tx, err := BeginTx(ctx, s.db)
+	if err != nil {
+		return "", nil, err
+	}
+	defer tx.Rollback()
+
+	// Insert the key, or take over an expired (or stale) one. If neither happens, then RETURNING produces no rows.
+	rows, err := tx.Raw(`
+		INSERT INTO nf_idempotency (key, fingerprint, reservation, completed, status, created_at, expires_at)
+		VALUES (?, ?, ?, false, 0, now(), ?)
+		ON CONFLICT (key) DO UPDATE SET
+			fingerprint = EXCLUDED.fingerprint, reservation = EXCLUDED.reservation, completed = false, status = 0,
+			header = NULL, body = NULL, created_at = now(), expires_at = EXCLUDED.expires_at
+		WHERE nf_idempotency.expires_at < now() OR (NOT nf_idempotency.completed AND nf_idempotency.created_at < ?)
+		RETURNING key`, key, fingerprint, reservation, expires, time.Now().Add(-staleAfter)).Rows()
+	if err != nil {
+		return "", nil, err
+	}
+	reserved := rows.Next()
+	rows.Close()
+	if reserved {
+		return reservation, nil, tx.Commit().Error
+	}
+
+	var header *string
+	resp := &nfidempotency.Response{}
+	err = tx.Raw(`SELECT fingerprint, completed, status, header, body FROM nf_idempotency WHERE key = ?`, key).Row().
+		Scan(&resp.Fingerprint, &resp.Completed, &resp.Status, &header, &resp.Body)
+	if err != nil {
+		return "", nil, err
+	}
+	if header != nil {
+		resp.Header = http.Header{}
+		if err := json.Unmarshal([]byte(*header), &resp.Header); err != nil {
+			return "", nil, err
+		}
+	}
+	return "", resp, tx.Commit().Error
+}
+
+// Complete implements nfidempotency.Store
+func (s *IdempotencyStore) Complete(ctx context.Context, key, reservation string, response *nfidempotency.Response) error {
+	header, err := json.Marshal(response.Header)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.DB().ExecContext(ctx, `UPDATE nf_idempotency SET completed = true, status = $1, header = $2, body = $3 WHERE key = $4 AND reservation = $5`,
+		response.Status, string(header), response.Body, key, reservation)
+	return err
+}
+
+// Release implements nfidempotency.Store
+func (s *IdempotencyStore) Release(ctx context.Context, key, reservation string) error {
+	_, err := s.db.DB().ExecContext(ctx, `DELETE FROM nf_idempotency WHERE key = $1 AND reservation = $2 AND NOT completed`, key, reservation)
+	return err
+}
+
+// Purge deletes the expired keys.
+func (s *IdempotencyStore) Purge(ctx context.Context) error {
+	_, err := s.db.DB().ExecContext(ctx, `DELETE FROM nf_idempotency WHERE expires_at < now()`)
+	return err
+}
+
+func (s *IdempotencyStore) purgeOccasionally() {
+	s.lock.Lock()
+	due := time.Since(s.lastPurge) > time.Hour
+	if due {
+		s.lastPurge = time.Now()
+	}
+	s.lock.Unlock()
+	if due {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			s.Purge(ctx)
+		}()
+	}
+}
+
+// newReservation returns a random token, which identifies a request that reserved a key
+func newReservation() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,244 @@
+package nfdb
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IMQS/log"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+)
+
+// Notification is a payload that was sent with NOTIFY (or pg_notify).
+type Notification struct {
+	Channel string
+	Payload string
+	// Reconnected is true if this is not a real notification, but a signal that the connection to the database was lost
+	// and has been restored. Notifications may have been missed in the meantime, so you should reload whatever state
+	// you are keeping in sync with the database.
+	Reconnected bool
+}
+
+// ListenerBuffer is the number of notifications that may be waiting for a subscriber. If a subscriber falls further
+// behind than that, then notifications for it are dropped (and a warning is logged), so that one slow subscriber
+// cannot hold up the others.
+const ListenerBuffer = 64
+
+// Listener subscribes to Postgres LISTEN/NOTIFY channels over a dedicated connection. If the connection is lost, then
+// it reconnects with exponential backoff (from 1 second up to 1 minute), and listens to all of its channels again.
+type Listener struct {
+	log      *log.Logger
+	listener *pq.Listener
+
+	// listenLock serialises LISTEN and UNLISTEN, so that they reach the database in the same order as the
+	// subscriptions that caused them. It is never held while waiting for lock.
+	listenLock sync.Mutex
+
+	lock        sync.Mutex
+	subscribers map[string][]chan Notification
+	done        chan struct{}
+	closeOnce   sync.Once
+}
+
+// NewListener creates a listener. dsn is typically DBConfig.DSN(). log may be nil.
+func NewListener(log *log.Logger, dsn string) *Listener {
+	l := &Listener{
+		log:         log,
+		subscribers: map[string][]chan Notification{},
+		done:        make(chan struct{}),
+	}
+	l.listener = pq.NewListener(dsn, time.Second, time.Minute, l.onEvent)
+	go l.dispatch()
+	return l
+}
+
+func (l *Listener) onEvent(event pq.ListenerEventType, err error) {
+	if l.log == nil {
+		return
+	}
+	switch event {
+	case pq.ListenerEventDisconnected:
+		l.log.Warnf("Listener lost its database connection: %v", err)
+	case pq.ListenerEventReconnected:
+		l.log.Infof("Listener reconnected to the database")
+	case pq.ListenerEventConnectionAttemptFailed:
+		l.log.Warnf("Listener failed to connect to the database: %v", err)
+	}
+}
+
+// Subscribe starts listening to channel. Notifications arrive on the returned Go channel, until unsubscribe is called
+// or the Listener is closed, after which the Go channel is closed.
+// Subscribe waits until there is a database connection.
+func (l *Listener) Subscribe(channel string) (notifications <-chan Notification, unsubscribe func(), err error) {
+	l.listenLock.Lock()
+	defer l.listenLock.Unlock()
+
+	l.lock.Lock()
+	select {
+	case <-l.done:
+		l.lock.Unlock()
+		return nil, nil, fmt.Errorf("Listener is closed")
+	default:
+	}
+	first := len(l.subscribers[channel]) == 0
+	ch := make(chan Notification, ListenerBuffer)
+	l.subscribers[channel] = append(l.subscribers[channel], ch)
+	l.lock.Unlock()
+
+	if first {
+		// Listen waits for the database to acknowledge it, which only happens once dispatch has drained pq's
+		// notification channel, so we must not hold our lock here, otherwise we'd stall dispatch.
+		if err := l.listener.Listen(channel); err != nil && err != pq.ErrChannelAlreadyOpen {
+			l.removeSubscriber(channel, ch)
+			return nil, nil, err
+		}
+	}
+	var once sync.Once
+	unsubscribe = func() {
+		once.Do(func() { l.unsubscribe(channel, ch) })
+	}
+	return ch, unsubscribe, nil
+}
+
+func (l *Listener) unsubscribe(channel string, ch chan Notification) {
+	l.listenLock.Lock()
+	defer l.listenLock.Unlock()
+	if l.removeSubscriber(channel, ch) {
+		// Like Listen, this must not hold our lock (see Subscribe)
+		l.listener.Unlisten(channel)
+	}
+}
+
+// removeSubscriber removes ch from the subscribers of channel, and closes it.
+// Returns true if channel has no subscribers left.
+func (l *Listener) removeSubscriber(channel string, ch chan Notification) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	subs, ok := l.subscribers[channel]
+	if !ok {
+		// Closed in the meantime
+		return false
+	}
+	for i, s := range subs {
+		if s == ch {
+			subs = append(subs[:i:i], subs[i+1:]...)
+			close(ch)
+			break
+		}
+	}
+	if len(subs) != 0 {
+		l.subscribers[channel] = subs
+		return false
+	}
+	delete(l.subscribers, channel)
+	return true
+}
+
+// Close stops listening, and closes the Go channels of all subscribers.
+func (l *Listener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		l.lock.Lock()
+		close(l.done)
+		for _, subs := range l.subscribers {
+			for _, ch := range subs {
+				close(ch)
+			}
+		}
+		l.subscribers = map[string][]chan Notification{}
+		l.lock.Unlock()
+		err = l.listener.Close()
+	})
+	return err
+}
+
+func (l *Listener) dispatch() {
+	// A dead connection is only noticed when we use it, so ping it when things are quiet
+	ping := time.NewTicker(90 * time.Second)
+	defer ping.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ping.C:
+			go l.listener.Ping()
+		case n, ok := <-l.listener.Notify:
+			if !ok {
+				return
+			}
+			l.deliver(n)
+		}
+	}
+}
+
+// deliver sends n to its subscribers. A nil n means that the connection was re-established, which everybody needs to know about.
+func (l *Listener) deliver(n *pq.Notification) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for channel, subs := range l.subscribers {
+		if n != nil && n.Channel != channel {
+			continue
+		}
+		msg := Notification{Channel: channel, Reconnected: n == nil}
+		if n != nil {
+			msg.Payload = n.Extra
+		}
+		for _, ch := range subs {
+			select {
+			case ch <- msg:
+			default:
+				if l.log != nil {
+					l.log.Warnf("Listener dropped a notification on channel %v, because a subscriber is too slow", channel)
+				}
+			}
+		}
+	}
+}
+
+var notNameChar = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// NotifyTriggerSQL returns the SQL that creates a trigger, which sends a notification on channel whenever a row of table
+// is inserted, updated or deleted. The payload is a JSON object such as {"op": "UPDATE", "table": "asset", "id": 12},
+// where "id" is the value of keyColumn. If keyColumn is empty, then the payload has the entire row as "row" instead of "id",
+// but bear in mind that Postgres limits payloads to 8000 bytes.
+// The SQL can be run more than once, so it is suitable for a migration (see MakeMigrations), or for InstallNotifyTrigger.
+func NotifyTriggerSQL(table, channel, keyColumn string) string {
+	quotedTable := []string{}
+	for _, part := range strings.Split(table, ".") {
+		quotedTable = append(quotedTable, pq.QuoteIdentifier(part))
+	}
+	name := notNameChar.ReplaceAllString("nf_notify_"+table+"_"+channel, "_")
+	value := "'row', row_to_json(rec)"
+	if keyColumn != "" {
+		value = "'id', rec." + pq.QuoteIdentifier(keyColumn)
+	}
+	return fmt.Sprintf(`
+CREATE OR REPLACE FUNCTION %[1]v() RETURNS trigger AS $nf$
+DECLARE
+	rec RECORD;
+BEGIN
+	IF TG_OP = 'DELETE' THEN
+		rec := OLD;
+	ELSE
+		rec := NEW;
+	END IF;
+	PERFORM pg_notify(%[2]v, json_build_object('op', TG_OP, 'table', TG_TABLE_NAME, %[3]v)::text);
+	RETURN NULL;
+END;
+$nf$ LANGUAGE plpgsql;
+DROP TRIGGER IF EXISTS %[1]v ON %[4]v;
+CREATE TRIGGER %[1]v AFTER INSERT OR UPDATE OR DELETE ON %[4]v FOR EACH ROW EXECUTE PROCEDURE %[1]v();
+`, pq.QuoteIdentifier(name), quoteLiteral(channel), value, strings.Join(quotedTable, "."))
+}
+
+// InstallNotifyTrigger runs NotifyTriggerSQL.
+func InstallNotifyTrigger(db *gorm.DB, table, channel, keyColumn string) error {
+	return db.Exec(NotifyTriggerSQL(table, channel, keyColumn)).Error
+}
+
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
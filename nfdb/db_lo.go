@@ -0,0 +1,72 @@
+package nfdb
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/jinzhu/gorm"
+)
+
+// LargeObject is a Postgres large object that has been opened for reading.
+// It implements io.ReadSeeker, so it can be sent with nf.SendReader, which supports Range requests.
+// See https://www.postgresql.org/docs/current/largeobjects.html
+type LargeObject struct {
+	tx   *gorm.DB
+	fd   int
+	size int64
+}
+
+// invRead is the INV_READ mode of lo_open
+const invRead = 0x40000
+
+// OpenLargeObject opens a large object for reading. Large objects can only be accessed inside a transaction,
+// so tx must have been created with BeginTx (or db.Begin), and it must remain open until you are finished with the object.
+func OpenLargeObject(tx *gorm.DB, oid uint32) (*LargeObject, error) {
+	lo := &LargeObject{tx: tx}
+	if err := tx.Raw("SELECT lo_open(?, ?)", oid, invRead).Row().Scan(&lo.fd); err != nil {
+		return nil, fmt.Errorf("Failed to open large object %v: %w", oid, err)
+	}
+	size, err := lo.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = lo.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		lo.Close()
+		return nil, err
+	}
+	lo.size = size
+	return lo, nil
+}
+
+// Size returns the size of the object in bytes
+func (lo *LargeObject) Size() int64 {
+	return lo.size
+}
+
+func (lo *LargeObject) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	var chunk []byte
+	if err := lo.tx.Raw("SELECT loread(?, ?)", lo.fd, len(p)).Row().Scan(&chunk); err != nil {
+		return 0, err
+	}
+	if len(chunk) == 0 {
+		return 0, io.EOF
+	}
+	return copy(p, chunk), nil
+}
+
+func (lo *LargeObject) Seek(offset int64, whence int) (int64, error) {
+	// The whence values of lo_lseek64 are the same as io.SeekStart, io.SeekCurrent and io.SeekEnd
+	var pos int64
+	if err := lo.tx.Raw("SELECT lo_lseek64(?, ?, ?)", lo.fd, offset, whence).Row().Scan(&pos); err != nil {
+		return 0, err
+	}
+	return pos, nil
+}
+
+// Close closes the object. The transaction is not affected.
+func (lo *LargeObject) Close() error {
+	return lo.tx.Exec("SELECT lo_close(?)", lo.fd).Error
+}
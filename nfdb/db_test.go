@@ -1,13 +1,21 @@
 package nfdb
 
 import (
+	"context"
+	"database/sql/driver"
 	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
 	"strings"
 	"testing"
+	"time"
 	"unicode"
 
 	"github.com/IMQS/log"
+	"github.com/IMQS/nf/nfidempotency"
 	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
 	"gotest.tools/v3/assert"
 )
 
@@ -88,6 +96,16 @@ func TestSQL(t *testing.T) {
 	verify(",", "()")
 }
 
+func TestIsUnavailable(t *testing.T) {
+	assert.Assert(t, !IsUnavailable(nil))
+	assert.Assert(t, !IsUnavailable(gorm.ErrRecordNotFound))
+	assert.Assert(t, !IsUnavailable(&pq.Error{Code: "23505"})) // unique_violation
+	assert.Assert(t, IsUnavailable(&pq.Error{Code: "08006"}))  // connection_failure
+	assert.Assert(t, IsUnavailable(&pq.Error{Code: "53300"}))  // too_many_connections
+	assert.Assert(t, IsUnavailable(fmt.Errorf("query failed: %w", &pq.Error{Code: "57014"})))
+	assert.Assert(t, IsUnavailable(driver.ErrBadConn))
+}
+
 func TestGeom(t *testing.T) {
 	db := CreateTestDB(t)
 	defer db.Close()
@@ -153,3 +171,165 @@ func TestGeom(t *testing.T) {
 		t.Fatalf("Unexpected geometry value received from db. Expected value: %v, received value: %v", geoJSON, string(rawJSON))
 	}
 }
+
+func TestTxDeadline(t *testing.T) {
+	db := CreateTestDB(t)
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := Transaction(ctx, db, func(tx *gorm.DB) error {
+		return tx.Exec("SELECT pg_sleep(5)").Error
+	})
+	if err == nil {
+		t.Fatalf("Expected pg_sleep to be cancelled by statement_timeout")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Query was not cancelled at the deadline. It ran for %v", elapsed)
+	}
+
+	err = Transaction(context.Background(), db, func(tx *gorm.DB) error {
+		return tx.Exec("SELECT pg_sleep(0.01)").Error
+	})
+	assert.NilError(t, err)
+}
+
+func TestLargeObject(t *testing.T) {
+	db := CreateTestDB(t)
+	defer db.Close()
+
+	err := Transaction(context.Background(), db, func(tx *gorm.DB) error {
+		var oid uint32
+		if err := tx.Raw("SELECT lo_from_bytea(0, ?)", []byte("0123456789")).Row().Scan(&oid); err != nil {
+			return err
+		}
+		lo, err := OpenLargeObject(tx, oid)
+		if err != nil {
+			return err
+		}
+		defer lo.Close()
+		assert.Equal(t, lo.Size(), int64(10))
+		lo.Seek(3, io.SeekStart)
+		all, err := io.ReadAll(lo)
+		assert.NilError(t, err)
+		assert.Equal(t, string(all), "3456789")
+		return nil
+	})
+	assert.NilError(t, err)
+}
+
+func TestListener(t *testing.T) {
+	db := CreateTestDB(t)
+	defer db.Close()
+	assert.NilError(t, InstallNotifyTrigger(db, "poly_table", "poly_changes", "id"))
+
+	listener := NewListener(nil, DSN())
+	defer listener.Close()
+	changes, unsubscribe, err := listener.Subscribe("poly_changes")
+	assert.NilError(t, err)
+	defer unsubscribe()
+
+	assert.NilError(t, db.Exec(`INSERT INTO poly_table (id) VALUES (42)`).Error)
+	select {
+	case n := <-changes:
+		assert.Equal(t, n.Channel, "poly_changes")
+		assert.Equal(t, RemoveWhitespace(n.Payload), `{"op":"INSERT","table":"poly_table","id":42}`)
+	case <-time.After(5 * time.Second):
+		t.Fatal("No notification received")
+	}
+}
+
+func TestListenerUnsubscribeUnderLoad(t *testing.T) {
+	db := CreateTestDB(t)
+	defer db.Close()
+
+	listener := NewListener(nil, DSN())
+	defer listener.Close()
+	_, unsubscribe, err := listener.Subscribe("flood")
+	assert.NilError(t, err)
+
+	// Nobody reads our notifications, so pq's own buffer fills up while we unsubscribe
+	flooding := make(chan error, 1)
+	go func() {
+		flooding <- db.Exec(`SELECT pg_notify('flood', i::text) FROM generate_series(1, 5000) AS i`).Error
+	}()
+	assert.NilError(t, <-flooding)
+	unsubscribed := make(chan struct{})
+	go func() {
+		unsubscribe()
+		close(unsubscribed)
+	}()
+	select {
+	case <-unsubscribed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("unsubscribe deadlocked")
+	}
+
+	// A quick subscribe and unsubscribe must not leave us unsubscribed from a channel that has a subscriber
+	for i := 0; i < 10; i++ {
+		_, unsubscribe, err := listener.Subscribe("flood")
+		assert.NilError(t, err)
+		unsubscribe()
+	}
+	changes, unsubscribe, err := listener.Subscribe("flood")
+	assert.NilError(t, err)
+	defer unsubscribe()
+	assert.NilError(t, db.Exec(`SELECT pg_notify('flood', 'last')`).Error)
+	for {
+		select {
+		case n := <-changes:
+			if n.Payload == "last" {
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("No notification received after resubscribing")
+		}
+	}
+}
+
+func TestIdempotencyStore(t *testing.T) {
+	db := CreateTestDB(t)
+	defer db.Close()
+	store, err := NewIdempotencyStore(db)
+	assert.NilError(t, err)
+	ctx := context.Background()
+
+	reservation, existing, err := store.Begin(ctx, "k", "abc", time.Now().Add(time.Hour))
+	assert.NilError(t, err)
+	assert.Assert(t, existing == nil)
+	assert.Assert(t, reservation != "")
+
+	other, existing, err := store.Begin(ctx, "k", "abc", time.Now().Add(time.Hour))
+	assert.NilError(t, err)
+	assert.Equal(t, other, "")
+	assert.Equal(t, existing.Completed, false)
+
+	err = store.Complete(ctx, "k", reservation, &nfidempotency.Response{Status: 201, Header: http.Header{"Content-Type": {"text/plain"}}, Body: []byte("12")})
+	assert.NilError(t, err)
+	_, existing, err = store.Begin(ctx, "k", "abc", time.Now().Add(time.Hour))
+	assert.NilError(t, err)
+	assert.Equal(t, existing.Status, 201)
+	assert.Equal(t, existing.Header.Get("Content-Type"), "text/plain")
+	assert.Equal(t, string(existing.Body), "12")
+
+	// Once a stale reservation has been taken over, the original request can no longer complete or release it
+	store.StaleAfter = time.Millisecond
+	slow, _, err := store.Begin(ctx, "stale", "abc", time.Now().Add(time.Hour))
+	assert.NilError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	retry, existing, err := store.Begin(ctx, "stale", "abc", time.Now().Add(time.Hour))
+	assert.NilError(t, err)
+	assert.Assert(t, existing == nil)
+	assert.Assert(t, retry != slow)
+	store.StaleAfter = 0
+	assert.NilError(t, store.Complete(ctx, "stale", slow, &nfidempotency.Response{Status: 200, Body: []byte("slow")}))
+	assert.NilError(t, store.Release(ctx, "stale", slow))
+	_, existing, err = store.Begin(ctx, "stale", "abc", time.Now().Add(time.Hour))
+	assert.NilError(t, err)
+	assert.Equal(t, existing.Completed, false)
+	assert.NilError(t, store.Complete(ctx, "stale", retry, &nfidempotency.Response{Status: 200, Body: []byte("retry")}))
+	_, existing, err = store.Begin(ctx, "stale", "abc", time.Now().Add(time.Hour))
+	assert.NilError(t, err)
+	assert.Equal(t, string(existing.Body), "retry")
+}
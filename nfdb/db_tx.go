@@ -0,0 +1,98 @@
+package nfdb
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+)
+
+// BeginTx starts a transaction that is bound to ctx, which is typically the context of an HTTP request.
+// If ctx is cancelled before the transaction is committed, then the transaction is rolled back.
+//
+// GORM does not pass the context down to individual queries, so a query that is already running would
+// not be interrupted by the cancellation. To cover that case, if ctx has a deadline, and the database is
+// Postgres, then the transaction's statement_timeout is set (with SET LOCAL) to the time remaining until
+// the deadline, so that Postgres itself aborts any query that would run past it.
+func BeginTx(ctx context.Context, db *gorm.DB) (*gorm.DB, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	tx := db.BeginTx(ctx, &sql.TxOptions{})
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	if deadline, ok := ctx.Deadline(); ok && db.Dialect().GetName() == "postgres" {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			tx.Rollback()
+			return nil, context.DeadlineExceeded
+		}
+		// SET does not accept query parameters, but this is just an integer
+		ms := remaining.Milliseconds()
+		if ms < 1 {
+			ms = 1
+		}
+		if err := tx.Exec(fmt.Sprintf("SET LOCAL statement_timeout = %d", ms)).Error; err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	return tx, nil
+}
+
+// Transaction runs fn inside a transaction created by BeginTx. If fn returns an error or panics, then the
+// transaction is rolled back, otherwise it is committed. A panic is re-raised after the rollback, so that
+// nf.RunProtected can send the appropriate HTTP response.
+func Transaction(ctx context.Context, db *gorm.DB, fn func(tx *gorm.DB) error) error {
+	tx, err := BeginTx(ctx, db)
+	if err != nil {
+		return err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			tx.Rollback()
+		}
+	}()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	committed = true
+	return nil
+}
+
+// IsUnavailable returns true if err means that the database could not be reached, or could not serve the query
+// (eg a broken connection, too many connections, or a statement timeout). This is intended for nf.CircuitBreaker.IsFailure,
+// so that errors such as a constraint violation or gorm.ErrRecordNotFound do not open the circuit.
+func IsUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code.Class() {
+		case "08", // connection_exception
+			"53", // insufficient_resources, eg too_many_connections
+			"57": // operator_intervention, eg query_canceled, admin_shutdown
+			return true
+		}
+	}
+	return false
+}
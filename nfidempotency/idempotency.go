@@ -0,0 +1,31 @@
+// Package nfidempotency holds the types that are shared by nf.Idempotent and the stores that implement it
+// (such as nfdb.IdempotencyStore), so that the stores don't need to import nf itself.
+package nfidempotency
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Response is the stored outcome of a request with an Idempotency-Key.
+type Response struct {
+	Fingerprint string // Hash of the request, so that we can detect a key that is reused for a different request
+	Completed   bool   // False if the original request is still being processed
+	Status      int
+	Header      http.Header
+	Body        []byte
+}
+
+// Store persists Idempotency-Keys and their responses.
+type Store interface {
+	// Begin reserves key for a new request, and returns a token that identifies the reservation. If key is already
+	// reserved (and has not expired), then Begin returns what is stored for it instead, and an empty reservation.
+	Begin(ctx context.Context, key, fingerprint string, expires time.Time) (reservation string, existing *Response, err error)
+	// Complete stores the response of a request that was reserved by Begin. If the reservation has been taken over by
+	// another request in the meantime (because it went stale), then Complete does nothing.
+	Complete(ctx context.Context, key, reservation string, response *Response) error
+	// Release forgets a key, so that the request can be retried. This is called when the handler fails with a server error.
+	// Like Complete, it does nothing if the reservation has been taken over by another request.
+	Release(ctx context.Context, key, reservation string) error
+}
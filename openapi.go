@@ -0,0 +1,367 @@
+package nf
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// OpenAPIConfig describes the service in the generated OpenAPI document.
+type OpenAPIConfig struct {
+	Title       string
+	Version     string
+	Description string
+	PublicPath  string // eg /facilities, if the service runs behind the IMQS router. May be empty.
+}
+
+// OpenAPIDocument generates an OpenAPI 3 document from all routes that have been registered through nf.
+// The result is ready to be marshalled to JSON.
+func OpenAPIDocument(config OpenAPIConfig) map[string]interface{} {
+	return openAPIDocument(config, Routes())
+}
+
+func openAPIDocument(config OpenAPIConfig, routes []Route) map[string]interface{} {
+	gen := &schemaGenerator{
+		schemas:      map[string]interface{}{},
+		names:        map[reflect.Type]string{},
+		operationIDs: map[string]bool{},
+	}
+
+	paths := map[string]map[string]interface{}{}
+	for _, r := range routes {
+		if r.Static || r.Method == "OPTIONS" {
+			continue
+		}
+		p := openAPIPath(r.Path)
+		if paths[p] == nil {
+			paths[p] = map[string]interface{}{}
+		}
+		paths[p][strings.ToLower(r.Method)] = gen.operation(r)
+	}
+
+	info := map[string]interface{}{
+		"title":   config.Title,
+		"version": config.Version,
+	}
+	if config.Description != "" {
+		info["description"] = config.Description
+	}
+	doc := map[string]interface{}{
+		"openapi": "3.0.3",
+		"info":    info,
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": gen.schemas,
+			"securitySchemes": map[string]interface{}{
+				"imqsSession": map[string]interface{}{
+					"type": "apiKey",
+					"in":   "cookie",
+					"name": "session",
+				},
+			},
+		},
+	}
+	if config.PublicPath != "" {
+		doc["servers"] = []interface{}{map[string]interface{}{"url": config.PublicPath}}
+	}
+	return doc
+}
+
+// HandleOpenAPI serves the OpenAPI document at path (eg /api/openapi.json).
+// The document is generated on every request, so routes that are registered after this call are included.
+func HandleOpenAPI(router *httprouter.Router, path string, config OpenAPIConfig) {
+	router.Handle("GET", path, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		RunProtected(w, func() {
+			w.Header().Set("Cache-Control", "no-cache")
+			SendJSON(w, OpenAPIDocument(config))
+		})
+	})
+}
+
+// HandleOpenAPIViewer serves a minimal, self-contained HTML page at path, which renders the OpenAPI document found at specURL.
+// specURL may be relative to path. The viewer does not load anything from the internet.
+func HandleOpenAPIViewer(router *httprouter.Router, path, specURL string) {
+	page := strings.Replace(openAPIViewerHTML, "{{SPEC_URL}}", strconv.Quote(specURL), 1)
+	router.Handle("GET", path, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(page))
+	})
+}
+
+var httprouterParam = regexp.MustCompile(`/[:*]([^/]+)`)
+var notOperationID = regexp.MustCompile(`[^a-zA-Z0-9]+`)
+var notSchemaName = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// openAPIPath converts /api/asset/:id to /api/asset/{id}
+func openAPIPath(path string) string {
+	return httprouterParam.ReplaceAllString(path, "/{$1}")
+}
+
+type schemaGenerator struct {
+	schemas      map[string]interface{} // components/schemas
+	names        map[reflect.Type]string
+	operationIDs map[string]bool
+}
+
+// operationID derives an ID from the method and path, eg get_api_asset_id. Paths that differ only in punctuation
+// (eg /a/b and /a-b) would get the same ID, so a number is added to make it unique.
+func (g *schemaGenerator) operationID(r Route) string {
+	base := strings.ToLower(r.Method) + strings.TrimRight(notOperationID.ReplaceAllString(r.Path, "_"), "_")
+	id := base
+	for i := 2; g.operationIDs[id]; i++ {
+		id = base + "_" + strconv.Itoa(i)
+	}
+	g.operationIDs[id] = true
+	return id
+}
+
+func (g *schemaGenerator) operation(r Route) map[string]interface{} {
+	op := map[string]interface{}{
+		"operationId": g.operationID(r),
+	}
+	if r.Summary != "" {
+		op["summary"] = r.Summary
+	}
+	if r.Description != "" {
+		op["description"] = r.Description
+	}
+	if len(r.Tags) != 0 {
+		op["tags"] = r.Tags
+	}
+	if len(r.Params) != 0 {
+		params := []interface{}{}
+		for _, p := range r.Params {
+			param := map[string]interface{}{
+				"name":     p.Name,
+				"in":       p.In,
+				"required": p.Required,
+				"schema":   map[string]interface{}{"type": p.Type},
+			}
+			if p.Description != "" {
+				param["description"] = p.Description
+			}
+			params = append(params, param)
+		}
+		op["parameters"] = params
+	}
+	if r.RequestType != nil {
+		op["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": g.schema(r.RequestType)},
+			},
+		}
+	}
+
+	responses := map[string]interface{}{
+		"default": map[string]interface{}{
+			"description": "Error",
+			"content": map[string]interface{}{
+				"text/plain": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+			},
+		},
+	}
+	if r.ResponseType != nil {
+		responses["200"] = map[string]interface{}{
+			"description": "OK",
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": g.schema(r.ResponseType)},
+			},
+		}
+	} else {
+		responses["200"] = map[string]interface{}{"description": "OK"}
+	}
+	if r.Authenticated {
+		op["security"] = []interface{}{map[string]interface{}{"imqsSession": []string{}}}
+		responses["401"] = map[string]interface{}{"description": "Not logged in"}
+		responses["403"] = map[string]interface{}{"description": "Forbidden"}
+		if len(r.Permissions) != 0 {
+			op["x-permissions"] = r.Permissions
+		}
+	}
+	op["responses"] = responses
+	return op
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+var rawMessageType = reflect.TypeOf(json.RawMessage{})
+
+// schema returns the JSON schema of t. Named structs are placed into components/schemas, and referenced.
+func (g *schemaGenerator) schema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == rawMessageType:
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer", "format": "int32"}
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32:
+		return map[string]interface{}{"type": "number", "format": "float"}
+	case reflect.Float64:
+		return map[string]interface{}{"type": "number", "format": "double"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + g.structName(t)}
+	}
+	// interface{} and anything else that we can't describe
+	return map[string]interface{}{}
+}
+
+// structName returns the component name of t, and generates the component if this is the first time we see t
+func (g *schemaGenerator) structName(t reflect.Type) string {
+	if name, ok := g.names[t]; ok {
+		return name
+	}
+	name := notSchemaName.ReplaceAllString(t.Name(), "_")
+	if _, exists := g.schemas[name]; exists {
+		// Two types with the same name, from different packages
+		name = notSchemaName.ReplaceAllString(t.String(), "_")
+	}
+	g.names[t] = name
+	g.schemas[name] = map[string]interface{}{} // placeholder, in case t is recursive
+	g.schemas[name] = g.structSchema(t)
+	return name
+}
+
+func (g *schemaGenerator) structSchema(t reflect.Type) map[string]interface{} {
+	props := map[string]interface{}{}
+	g.addStructFields(t, props)
+	return map[string]interface{}{
+		"type":       "object",
+		"properties": props,
+	}
+}
+
+// addStructFields follows the rules of encoding/json, including the flattening of embedded structs (such as nfdb.BaseModel)
+func (g *schemaGenerator) addStructFields(t reflect.Type, props map[string]interface{}) {
+	fields := []reflect.StructField{}
+	for i := 0; i < t.NumField(); i++ {
+		fields = append(fields, t.Field(i))
+	}
+	sort.SliceStable(fields, func(i, j int) bool { return fields[i].Anonymous && !fields[j].Anonymous })
+	for _, f := range fields {
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		ft := f.Type
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+			g.addStructFields(ft, props)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		if strings.Contains(opts, "string") {
+			props[name] = map[string]interface{}{"type": "string"}
+		} else {
+			props[name] = g.schema(f.Type)
+		}
+	}
+}
+
+const openAPIViewerHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>API</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+details { border: 1px solid #ccc; border-radius: 4px; margin: 0.4em 0; padding: 0.4em 0.8em; }
+summary { cursor: pointer; }
+.method { display: inline-block; width: 5em; font-weight: bold; text-transform: uppercase; }
+.get { color: #1a7f37; } .post { color: #0969da; } .put { color: #9a6700; } .delete { color: #cf222e; }
+pre { background: #f6f8fa; padding: 0.6em; overflow: auto; }
+.perm { color: #888; font-size: 0.9em; }
+</style>
+</head>
+<body>
+<h1 id="title">API</h1>
+<p id="description"></p>
+<div id="ops"></div>
+<script>
+var specURL = {{SPEC_URL}};
+function el(tag, cls, text) {
+	var e = document.createElement(tag);
+	if (cls) e.className = cls;
+	if (text) e.textContent = text;
+	return e;
+}
+function resolve(spec, s, depth) {
+	if (!s || depth > 5) return s;
+	if (s.$ref) return resolve(spec, spec.components.schemas[s.$ref.split("/").pop()], depth + 1);
+	var out = Array.isArray(s) ? [] : {};
+	for (var k in s) out[k] = typeof s[k] === "object" ? resolve(spec, s[k], depth + 1) : s[k];
+	return out;
+}
+fetch(specURL).then(function(r) { return r.json(); }).then(function(spec) {
+	document.title = spec.info.title;
+	document.getElementById("title").textContent = spec.info.title + " " + spec.info.version;
+	document.getElementById("description").textContent = spec.info.description || "";
+	var ops = document.getElementById("ops");
+	Object.keys(spec.paths).sort().forEach(function(path) {
+		Object.keys(spec.paths[path]).forEach(function(method) {
+			var op = spec.paths[path][method];
+			var d = el("details");
+			var s = el("summary");
+			s.appendChild(el("span", "method " + method, method));
+			s.appendChild(el("code", "", path));
+			if (op.summary) s.appendChild(el("span", "", " - " + op.summary));
+			if (op["x-permissions"]) s.appendChild(el("span", "perm", " (permissions " + op["x-permissions"].join(", ") + ")"));
+			d.appendChild(s);
+			if (op.description) d.appendChild(el("p", "", op.description));
+			(op.parameters || []).forEach(function(p) {
+				d.appendChild(el("div", "", p.in + " " + p.name + ": " + p.schema.type + (p.required ? " (required)" : "") + (p.description ? " - " + p.description : "")));
+			});
+			if (op.requestBody) {
+				d.appendChild(el("h4", "", "Request"));
+				d.appendChild(el("pre", "", JSON.stringify(resolve(spec, op.requestBody.content["application/json"].schema, 0), null, 2)));
+			}
+			var ok = op.responses["200"];
+			if (ok && ok.content) {
+				d.appendChild(el("h4", "", "Response"));
+				d.appendChild(el("pre", "", JSON.stringify(resolve(spec, ok.content["application/json"].schema, 0), null, 2)));
+			}
+			ops.appendChild(d);
+		});
+	});
+});
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,88 @@
+package nf
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IMQS/serviceauth"
+	"github.com/julienschmidt/httprouter"
+	"gotest.tools/v3/assert"
+)
+
+type openAPIBase struct {
+	ID int64 `json:"id"`
+}
+
+type openAPIAsset struct {
+	openAPIBase
+	Name     string
+	Size     float64         `json:"size,omitempty"`
+	Count    int64           `json:",string"`
+	Created  time.Time       `json:"created"`
+	Parent   *openAPIAsset   `json:"parent"`
+	Tags     []string        `json:"tags"`
+	Extra    json.RawMessage `json:"extra"`
+	Attrs    map[string]int
+	Secret   string `json:"-"`
+	internal int
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	// Only the routes registered here go into the document, regardless of what other tests (or earlier runs) registered
+	before := len(Routes())
+	router := httprouter.New()
+	ok := func(w http.ResponseWriter, r *http.Request, p httprouter.Params) { SendOK(w) }
+	HandleJSON(router, "POST", "/openapi-test/assets", func(r *http.Request, p httprouter.Params, req *openAPIAsset) openAPIAsset {
+		return *req
+	}, Summary("Create an asset"), Tags("assets"))
+	HandleAuthenticatedJSON(router, "GET", "/openapi-test/assets/:id", func(r *http.Request, p httprouter.Params, auth *serviceauth.Token, req *NoBody) []openAPIAsset {
+		return nil
+	}, []int{12}, PathParam("id", "integer", "Asset ID"), QueryParam("depth", "integer", "", false))
+	Handle(router, "GET", "/openapi-test/files/*path", ok)
+	// These two would have the same operationId
+	Handle(router, "GET", "/openapi-test/a/b", ok)
+	Handle(router, "GET", "/openapi-test/a-b", ok)
+
+	doc := openAPIDocument(OpenAPIConfig{Title: "Test", Version: "1.0", PublicPath: "/test"}, Routes()[before:])
+	actual, err := json.MarshalIndent(doc, "", "\t")
+	assert.NilError(t, err)
+	golden, err := os.ReadFile("testdata/openapi.golden.json")
+	assert.NilError(t, err)
+	assert.Equal(t, string(actual), string(golden))
+}
+
+func TestHandleJSON(t *testing.T) {
+	router := httprouter.New()
+	HandleJSON(router, "POST", "/typed-test/echo/:id", func(r *http.Request, p httprouter.Params, req *openAPIAsset) *openAPIAsset {
+		req.ID = ParseID(p.ByName("id"))
+		return req
+	})
+	HandleJSON(router, "DELETE", "/typed-test/echo/:id", func(r *http.Request, p httprouter.Params, req *NoBody) NoBody {
+		return NoBody{}
+	})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/typed-test/echo/7", strings.NewReader(`{"Name": "pump", "Count": "3"}`)))
+	assert.Equal(t, w.Code, 200)
+	assert.Equal(t, w.Header().Get("Content-Type"), "application/json")
+	var resp openAPIAsset
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, resp.ID, int64(7))
+	assert.Equal(t, resp.Name, "pump")
+	assert.Equal(t, resp.Count, int64(3))
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/typed-test/echo/7", strings.NewReader(`{"Name": `)))
+	assert.Equal(t, w.Code, http.StatusBadRequest)
+
+	// NoBody doesn't read the request, and sends 204
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", "/typed-test/echo/7", nil))
+	assert.Equal(t, w.Code, http.StatusNoContent)
+	assert.Equal(t, w.Body.Len(), 0)
+}
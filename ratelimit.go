@@ -0,0 +1,209 @@
+package nf
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IMQS/serviceauth"
+)
+
+// TrustProxyHeaders causes ClientIP to use the X-Forwarded-For and X-Real-IP headers.
+// Only enable this if the service is always behind a reverse proxy (such as the IMQS router) that sets these headers,
+// otherwise clients can choose their own IP address.
+var TrustProxyHeaders = false
+
+// RateLimitKey returns the identity of the client that a rate limit applies to.
+// auth is nil if the route is not authenticated.
+type RateLimitKey func(r *http.Request, auth *serviceauth.Token) string
+
+// RateLimitByUser keys by the user ID of the authentication token, and falls back to the client IP for routes that are not authenticated.
+func RateLimitByUser(r *http.Request, auth *serviceauth.Token) string {
+	if auth != nil {
+		return "user:" + strconv.FormatInt(int64(auth.UserId), 10)
+	}
+	return RateLimitByIP(r, auth)
+}
+
+// RateLimitByIP keys by the IP address of the client. See TrustProxyHeaders.
+func RateLimitByIP(r *http.Request, auth *serviceauth.Token) string {
+	return "ip:" + ClientIP(r)
+}
+
+// RateLimitByHeader keys by the value of the given header (for example an API key), and falls back
+// to the client IP if the header is not present, or if known returns false for its value.
+// known is required, because a client could otherwise escape the limit by sending a new value with every request.
+func RateLimitByHeader(header string, known func(value string) bool) RateLimitKey {
+	if known == nil {
+		panic("RateLimitByHeader needs a function that validates the header")
+	}
+	return func(r *http.Request, auth *serviceauth.Token) string {
+		if v := r.Header.Get(header); v != "" && known(v) {
+			return "header:" + v
+		}
+		return RateLimitByIP(r, auth)
+	}
+}
+
+// MaxRateLimitClients is the number of clients that a RateLimiter keeps track of. Once it is tracking that many,
+// new clients share a single bucket, until the buckets of idle clients are discarded.
+var MaxRateLimitClients = 100000
+
+// overflowKey is the bucket shared by new clients when a RateLimiter is full
+const overflowKey = "\x00overflow"
+
+// ClientIP returns the IP address of the client. See TrustProxyHeaders.
+func ClientIP(r *http.Request) string {
+	if TrustProxyHeaders {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			first, _, _ := strings.Cut(fwd, ",")
+			return strings.TrimSpace(first)
+		}
+		if real := r.Header.Get("X-Real-IP"); real != "" {
+			return real
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// RateLimiter is a set of token buckets, one per client. A single RateLimiter may be shared by several routes,
+// in which case the clients' budgets are shared between those routes too.
+type RateLimiter struct {
+	rate  float64 // tokens per second
+	burst float64
+	key   RateLimitKey
+
+	lock      sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter creates a limiter that allows each client 'rate' requests per second on average, with bursts of up to 'burst' requests.
+// If key is nil, then RateLimitByUser is used.
+func NewRateLimiter(rate float64, burst int, key RateLimitKey) *RateLimiter {
+	if rate <= 0 || burst < 1 {
+		panic("RateLimiter needs a positive rate and a burst of at least 1")
+	}
+	if key == nil {
+		key = RateLimitByUser
+	}
+	return &RateLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		key:       key,
+		buckets:   map[string]*tokenBucket{},
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow takes a token from the bucket of the given client. If the bucket is empty, then Allow returns false,
+// along with the time until the next token becomes available.
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	now := time.Now()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.sweep(now, time.Minute)
+	b := l.buckets[key]
+	if b == nil && len(l.buckets) >= MaxRateLimitClients {
+		// Sweeping a full map is expensive, so we don't do it for every new client
+		l.sweep(now, time.Second)
+		if len(l.buckets) >= MaxRateLimitClients {
+			key = overflowKey
+			b = l.buckets[key]
+		}
+	}
+	if b == nil {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// sweep discards the buckets that have refilled completely, so that the map does not grow without bound.
+// Nothing happens if the previous sweep was less than interval ago. Must be called with the lock held.
+func (l *RateLimiter) sweep(now time.Time, interval time.Duration) {
+	if now.Sub(l.lastSweep) < interval {
+		return
+	}
+	l.lastSweep = now
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for k, b := range l.buckets {
+		if now.Sub(b.last) > full {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// RateLimit applies limiter to a route. Requests beyond the limit receive 429 Too Many Requests, with a Retry-After header.
+func RateLimit(limiter *RateLimiter) RouteOption {
+	return func(r *Route) {
+		r.rateLimiter = limiter
+	}
+}
+
+// MaxInFlight limits the number of concurrent requests to a route. Requests beyond the limit are shed immediately,
+// with 503 Service Unavailable and a Retry-After header.
+func MaxInFlight(n int) RouteOption {
+	return func(r *Route) {
+		r.maxInFlight = int64(n)
+	}
+}
+
+var httpRejected = DefaultMetrics.NewCounter("nf_http_rejected_total", "Number of requests rejected by rate or concurrency limits, by route.", "method", "route", "reason")
+
+// allow enforces the route's rate limit. If the request is rejected, then the response has been sent, and allow returns false.
+func (r *Route) allow(w http.ResponseWriter, req *http.Request, auth *serviceauth.Token) bool {
+	if r.rateLimiter == nil {
+		return true
+	}
+	ok, wait := r.rateLimiter.Allow(r.rateLimiter.key(req, auth))
+	if ok {
+		return true
+	}
+	httpRejected.Inc(r.Method, r.Path, "rate")
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+	return false
+}
+
+// acquire enforces the route's concurrency limit. If acquire returns true, then release must be called when the request is finished.
+// If the request is rejected, then the response has been sent, and acquire returns false.
+func (r *Route) acquire(w http.ResponseWriter) bool {
+	if r.maxInFlight == 0 {
+		return true
+	}
+	if atomic.AddInt64(&r.stats.inFlight, 1) <= r.maxInFlight {
+		return true
+	}
+	atomic.AddInt64(&r.stats.inFlight, -1)
+	httpRejected.Inc(r.Method, r.Path, "concurrency")
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, "Server Busy", http.StatusServiceUnavailable)
+	return false
+}
+
+func (r *Route) release() {
+	if r.maxInFlight != 0 {
+		atomic.AddInt64(&r.stats.inFlight, -1)
+	}
+}
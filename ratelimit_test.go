@@ -0,0 +1,111 @@
+package nf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"gotest.tools/v3/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := NewRateLimiter(10, 3, nil)
+	for i := 0; i < 3; i++ {
+		ok, _ := l.Allow("a")
+		assert.Assert(t, ok)
+	}
+	ok, wait := l.Allow("a")
+	assert.Assert(t, !ok)
+	assert.Assert(t, wait > 0 && wait <= 100*time.Millisecond, "wait is %v", wait)
+
+	// Other clients have their own bucket
+	ok, _ = l.Allow("b")
+	assert.Assert(t, ok)
+
+	// The bucket refills at the given rate
+	time.Sleep(wait + 10*time.Millisecond)
+	ok, _ = l.Allow("a")
+	assert.Assert(t, ok)
+	ok, _ = l.Allow("a")
+	assert.Assert(t, !ok)
+}
+
+func TestRateLimiterFull(t *testing.T) {
+	defer func(max int) { MaxRateLimitClients = max }(MaxRateLimitClients)
+	MaxRateLimitClients = 10
+	l := NewRateLimiter(1, 2, nil)
+	for i := 0; i < 10; i++ {
+		l.Allow(strconv.Itoa(i))
+	}
+	// New clients share a single bucket, so a stream of new keys cannot escape the limit
+	ok1, _ := l.Allow("new1")
+	ok2, _ := l.Allow("new2")
+	ok3, _ := l.Allow("new3")
+	assert.Assert(t, ok1 && ok2 && !ok3)
+	assert.Equal(t, len(l.buckets), 11)
+}
+
+func TestRateLimit(t *testing.T) {
+	apiKeys := map[string]bool{"key1": true}
+	limiter := NewRateLimiter(0.1, 1, RateLimitByHeader("X-API-Key", func(v string) bool { return apiKeys[v] }))
+	router := httprouter.New()
+	Handle(router, "GET", "/ratelimit", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) { SendOK(w) }, RateLimit(limiter))
+	get := func(apiKey, ip string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/ratelimit", nil)
+		r.RemoteAddr = ip + ":1234"
+		if apiKey != "" {
+			r.Header.Set("X-API-Key", apiKey)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	assert.Equal(t, get("key1", "10.0.0.1").Code, 200)
+	w := get("key1", "10.0.0.2")
+	assert.Equal(t, w.Code, http.StatusTooManyRequests)
+	assert.Equal(t, w.Header().Get("Retry-After"), "10")
+
+	// An unknown key doesn't get its own bucket, so making up keys doesn't help
+	assert.Equal(t, get("made-up-1", "10.0.0.3").Code, 200)
+	assert.Equal(t, get("made-up-2", "10.0.0.3").Code, http.StatusTooManyRequests)
+	assert.Equal(t, get("", "10.0.0.3").Code, http.StatusTooManyRequests)
+	assert.Equal(t, get("", "10.0.0.4").Code, 200)
+}
+
+func TestMaxInFlight(t *testing.T) {
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	router := httprouter.New()
+	Handle(router, "GET", "/maxinflight", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		entered <- struct{}{}
+		<-release
+		SendOK(w)
+	}, MaxInFlight(1))
+
+	first := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		router.ServeHTTP(first, httptest.NewRequest("GET", "/maxinflight", nil))
+		close(done)
+	}()
+	<-entered
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/maxinflight", nil))
+	assert.Equal(t, w.Code, http.StatusServiceUnavailable)
+	assert.Equal(t, w.Header().Get("Retry-After"), "1")
+
+	close(release)
+	<-done
+	assert.Equal(t, first.Code, 200)
+
+	// Once the first request is finished, there is room again
+	go func() { <-entered }()
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/maxinflight", nil))
+	assert.Equal(t, w.Code, 200)
+}
@@ -0,0 +1,303 @@
+package nf
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IMQS/serviceauth"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Route describes an HTTP route that was registered through Handle, HandleAuthenticated, one of their typed variants,
+// or HandleStaticFiles. The information here is used to generate API documentation, and by HandleRoutesAdmin.
+type Route struct {
+	Method        string
+	Path          string // httprouter syntax, eg /api/asset/:id
+	Summary       string
+	Description   string
+	Tags          []string
+	Authenticated bool
+	Permissions   []int // The permissions that were passed to HandleAuthenticated
+	Params        []RouteParam
+	RequestType   reflect.Type // nil if unknown
+	ResponseType  reflect.Type // nil if unknown
+	Static        bool         // True if this route was registered by HandleStaticFiles
+	CORS          *CORSPolicy  // nil if cross-origin requests are not allowed
+
+	corsSet     bool // True if CORS was set by a RouteOption, in which case DefaultCORS does not apply
+	rateLimiter *RateLimiter
+	maxInFlight int64
+	timeout     time.Duration
+	compression *CompressionConfig
+	security    *SecurityHeaders
+	stats       *routeStats
+
+	idempotency       IdempotencyStore
+	idempotencyExpiry time.Duration
+}
+
+// RouteStats are the runtime statistics of a route.
+type RouteStats struct {
+	Hits          int64
+	Errors        int64  // Number of responses with a status code of 400 or higher
+	LastError     string // The start of the response body of the most recent error
+	LastErrorCode int
+	LastErrorTime time.Time
+}
+
+// RouteParam describes a path, query or header parameter of a route.
+type RouteParam struct {
+	Name        string
+	In          string // "path", "query" or "header"
+	Type        string // A JSON schema type, eg "string" or "integer"
+	Required    bool
+	Description string
+}
+
+// RouteOption sets optional properties of a route, when it is registered with Handle or HandleAuthenticated.
+type RouteOption func(r *Route)
+
+// Summary sets the one-line summary of a route.
+func Summary(summary string) RouteOption {
+	return func(r *Route) {
+		r.Summary = summary
+	}
+}
+
+// Description sets the long description of a route.
+func Description(description string) RouteOption {
+	return func(r *Route) {
+		r.Description = description
+	}
+}
+
+// Tags sets the tags of a route, which are used to group operations in API documentation.
+func Tags(tags ...string) RouteOption {
+	return func(r *Route) {
+		r.Tags = append(r.Tags, tags...)
+	}
+}
+
+// QueryParam documents a query parameter. typ is a JSON schema type, such as "string" or "integer".
+func QueryParam(name, typ, description string, required bool) RouteOption {
+	return func(r *Route) {
+		r.Params = append(r.Params, RouteParam{Name: name, In: "query", Type: typ, Required: required, Description: description})
+	}
+}
+
+// HeaderParam documents a header parameter.
+func HeaderParam(name, description string, required bool) RouteOption {
+	return func(r *Route) {
+		r.Params = append(r.Params, RouteParam{Name: name, In: "header", Type: "string", Required: required, Description: description})
+	}
+}
+
+// PathParam documents a path parameter. Path parameters are detected automatically,
+// so you only need this to add a type or description.
+func PathParam(name, typ, description string) RouteOption {
+	return func(r *Route) {
+		for i := range r.Params {
+			if r.Params[i].In == "path" && r.Params[i].Name == name {
+				r.Params[i].Type = typ
+				r.Params[i].Description = description
+				return
+			}
+		}
+		r.Params = append(r.Params, RouteParam{Name: name, In: "path", Type: typ, Required: true, Description: description})
+	}
+}
+
+// RequestBody documents the type of the JSON request body, for routes that are not registered with a typed handler.
+// Pass in a value of the body type, eg RequestBody(Asset{}).
+func RequestBody(obj interface{}) RouteOption {
+	return func(r *Route) {
+		r.RequestType = reflect.TypeOf(obj)
+	}
+}
+
+// ResponseBody documents the type of the JSON response body, for routes that are not registered with a typed handler.
+// Pass in a value of the body type, eg ResponseBody([]Asset{}).
+func ResponseBody(obj interface{}) RouteOption {
+	return func(r *Route) {
+		r.ResponseType = reflect.TypeOf(obj)
+	}
+}
+
+var routesLock sync.Mutex
+var routes []*Route
+
+// Routes returns a copy of all routes that have been registered through nf.
+func Routes() []Route {
+	routesLock.Lock()
+	defer routesLock.Unlock()
+	all := make([]Route, 0, len(routes))
+	for _, r := range routes {
+		all = append(all, *r)
+	}
+	return all
+}
+
+// Stats returns the hit count and error information of the route.
+func (r *Route) Stats() RouteStats {
+	s := r.stats
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return RouteStats{
+		Hits:          s.hits,
+		Errors:        s.errors,
+		LastError:     s.lastError,
+		LastErrorCode: s.lastErrorCode,
+		LastErrorTime: s.lastErrorTime,
+	}
+}
+
+// newRoute builds the description of a route, and adds it to the global list of routes
+func newRoute(method, path string, authenticated bool, permissions []int, opts []RouteOption) *Route {
+	r := &Route{
+		Method:        method,
+		Path:          path,
+		Authenticated: authenticated,
+		Permissions:   permissions,
+		Params:        pathParams(path),
+		timeout:       DefaultTimeout,
+		compression:   DefaultCompression,
+		security:      DefaultSecurityHeaders,
+		stats:         &routeStats{method: method, path: path},
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	if !r.corsSet && !r.Static {
+		r.CORS = DefaultCORS
+	}
+	if r.CORS != nil {
+		r.CORS.validate()
+	}
+	routesLock.Lock()
+	routes = append(routes, r)
+	routesLock.Unlock()
+	return r
+}
+
+// addRoute registers route with router. handle must return the recovered panic, if any (see runProtected).
+// This is where we do all the work that is common to every route registered through nf.
+func addRoute(router *httprouter.Router, route *Route, handle func(w http.ResponseWriter, r *http.Request, p httprouter.Params) interface{}) {
+	stats := route.stats
+	cors := route.CORS
+	security := route.security
+	router.Handle(route.Method, route.Path, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		sw := stats.begin(w)
+		if cors != nil {
+			cors.setHeaders(sw, r)
+		}
+		if security != nil {
+			r = security.setHeaders(sw, r)
+		}
+		var rec interface{}
+		if decodeRequestBodyOrFail(sw, r) && route.acquire(sw) {
+			r, cancel := route.withTimeout(r)
+			r, cleanup := withRequestCleanup(r)
+			writer, closeWriter := http.ResponseWriter(sw), func() {}
+			if route.compression != nil {
+				writer, closeWriter = route.compression.newCompressWriter(sw, r)
+			}
+			rec = handle(writer, r, p)
+			cleanup.run()
+			closeWriter()
+			if sw.status == 0 && r.Context().Err() != nil {
+				sendContextError(sw, r.Context().Err())
+			}
+			cancel()
+			route.release()
+		}
+		stats.end(sw, rec)
+	})
+	if cors != nil {
+		addPreflight(router, route)
+	}
+}
+
+// serve runs handler, after applying the rate limit and idempotency of the route.
+// Returns the recovered panic, if any (see runProtected).
+func (route *Route) serve(w http.ResponseWriter, r *http.Request, auth *serviceauth.Token, handler func(w http.ResponseWriter)) interface{} {
+	if !route.allow(w, r, auth) {
+		return nil
+	}
+	if key := r.Header.Get("Idempotency-Key"); key != "" && route.idempotency != nil {
+		return route.serveIdempotent(w, r, auth, key, handler)
+	}
+	return runProtected(w, r, func() { handler(w) })
+}
+
+// pathParams extracts the httprouter parameters out of path, eg /api/asset/:id yields "id"
+func pathParams(path string) []RouteParam {
+	params := []RouteParam{}
+	for _, part := range strings.Split(path, "/") {
+		if len(part) > 1 && (part[0] == ':' || part[0] == '*') {
+			params = append(params, RouteParam{Name: part[1:], In: "path", Type: "string", Required: true})
+		}
+	}
+	return params
+}
+
+// This is a variable so that tests can take permissions away
+var hasPermByID = (*serviceauth.Token).HasPermByID
+
+// RouteInfo is the JSON representation of a route, as sent by HandleRoutesAdmin.
+type RouteInfo struct {
+	Method        string
+	Path          string
+	Summary       string `json:",omitempty"`
+	Authenticated bool
+	Permissions   []int
+	Static        bool
+	RouteStats
+}
+
+// HandleRoutesAdmin serves a JSON list of all routes registered through nf, along with their required permissions,
+// hit counts and most recent error. This is intended for security reviews, and for debugging the IMQS router configuration.
+// The caller must be authenticated, and have all of needPermissions. With BypassAuth, nobody can be checked, so the
+// list is refused with 403 Forbidden.
+func HandleRoutesAdmin(router *httprouter.Router, path string, needPermissions []int) {
+	HandleAuthenticated(router, "GET", path, func(w http.ResponseWriter, r *http.Request, p httprouter.Params, auth *serviceauth.Token) {
+		if auth == nil {
+			Panic(http.StatusForbidden, "The route list is not available with BypassAuth")
+		}
+		for _, perm := range needPermissions {
+			if !hasPermByID(auth, perm) {
+				PanicForbidden()
+			}
+		}
+		routesLock.Lock()
+		all := append([]*Route{}, routes...)
+		routesLock.Unlock()
+		list := []RouteInfo{}
+		for _, route := range all {
+			perms := route.Permissions
+			if perms == nil {
+				perms = []int{}
+			}
+			list = append(list, RouteInfo{
+				Method:        route.Method,
+				Path:          route.Path,
+				Summary:       route.Summary,
+				Authenticated: route.Authenticated,
+				Permissions:   perms,
+				Static:        route.Static,
+				RouteStats:    route.Stats(),
+			})
+		}
+		sort.Slice(list, func(i, j int) bool {
+			if list[i].Path != list[j].Path {
+				return list[i].Path < list[j].Path
+			}
+			return list[i].Method < list[j].Method
+		})
+		w.Header().Set("Cache-Control", "no-cache")
+		SendJSON(w, list)
+	}, needPermissions, Summary("List all routes of this service"), Tags("admin"))
+}
@@ -0,0 +1,90 @@
+package nf
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/IMQS/serviceauth"
+	"github.com/julienschmidt/httprouter"
+	"gotest.tools/v3/assert"
+)
+
+func TestHandleRoutesAdmin(t *testing.T) {
+	const permAdmin = 1000
+	router := httprouter.New()
+	Handle(router, "GET", "/routes-test/ok", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		SendOK(w)
+	})
+	HandleAuthenticated(router, "POST", "/routes-test/fail", func(w http.ResponseWriter, r *http.Request, p httprouter.Params, auth *serviceauth.Token) {
+		PanicBadRequestf("Something is wrong")
+	}, []int{42})
+	HandleRoutesAdmin(router, "/routes-test/admin", []int{permAdmin})
+
+	stubAuth(t, map[string]*serviceauth.Token{"admin": {UserId: 1}})
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, path, nil)
+		r.Header.Set("Authorization", "admin")
+		router.ServeHTTP(w, r)
+		return w
+	}
+	serve("GET", "/routes-test/ok")
+	serve("GET", "/routes-test/ok")
+	serve("POST", "/routes-test/fail")
+
+	// An anonymous caller is refused, and so is a caller without one of the permissions
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/routes-test/admin", nil))
+	assert.Equal(t, w.Code, http.StatusUnauthorized)
+	defer func(orig func(*serviceauth.Token, int) bool) { hasPermByID = orig }(hasPermByID)
+	hasPermByID = func(auth *serviceauth.Token, perm int) bool { return perm != permAdmin }
+	assert.Equal(t, serve("GET", "/routes-test/admin").Code, http.StatusForbidden)
+
+	hasPermByID = func(auth *serviceauth.Token, perm int) bool { return true }
+	w = serve("GET", "/routes-test/admin")
+	assert.Equal(t, w.Code, 200)
+	var list []RouteInfo
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	found := map[string]RouteInfo{}
+	for _, info := range list {
+		found[info.Method+" "+info.Path] = info
+	}
+	ok := found["GET /routes-test/ok"]
+	assert.Equal(t, ok.Hits, int64(2))
+	assert.Equal(t, ok.Errors, int64(0))
+	assert.Equal(t, ok.Authenticated, false)
+	fail := found["POST /routes-test/fail"]
+	assert.Equal(t, fail.Hits, int64(1))
+	assert.Equal(t, fail.Errors, int64(1))
+	assert.Equal(t, fail.LastError, "Something is wrong")
+	assert.Equal(t, fail.LastErrorCode, http.StatusBadRequest)
+	assert.Assert(t, fail.Authenticated)
+	assert.DeepEqual(t, fail.Permissions, []int{42})
+	assert.DeepEqual(t, found["GET /routes-test/admin"].Permissions, []int{permAdmin})
+}
+
+func TestHandleRoutesAdminBypassAuth(t *testing.T) {
+	router := httprouter.New()
+	BypassAuth = true
+	HandleRoutesAdmin(router, "/routes-test/bypass", nil)
+	BypassAuth = false
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/routes-test/bypass", nil))
+	assert.Equal(t, w.Code, http.StatusForbidden)
+}
+
+// stubAuth replaces the auth service until the end of the test. A request with "Authorization: <name>" is
+// authenticated as tokens[name], and any other request is refused with 401.
+func stubAuth(t *testing.T, tokens map[string]*serviceauth.Token) {
+	orig := getToken
+	getToken = func(r *http.Request, breaker *CircuitBreaker, bulkhead *Bulkhead) (int, string, *serviceauth.Token) {
+		if token := tokens[r.Header.Get("Authorization")]; token != nil {
+			return http.StatusOK, "", token
+		}
+		return http.StatusUnauthorized, "Unauthorized", nil
+	}
+	t.Cleanup(func() { getToken = orig })
+}
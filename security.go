@@ -0,0 +1,130 @@
+package nf
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SecurityHeaders are the security related response headers of a route.
+// See https://owasp.org/www-project-secure-headers/
+type SecurityHeaders struct {
+	// HSTS is the max-age of Strict-Transport-Security. If zero, then the header is not sent.
+	// Browsers ignore this header on plain HTTP, so it is safe to send it behind a TLS terminating proxy.
+	HSTS                  time.Duration
+	HSTSIncludeSubdomains bool
+	// NoSniff sends X-Content-Type-Options: nosniff
+	NoSniff bool
+	// FrameOptions is "DENY" or "SAMEORIGIN". This is sent as X-Frame-Options, and as the equivalent
+	// frame-ancestors directive of the Content-Security-Policy, if the policy doesn't have its own frame-ancestors.
+	FrameOptions string
+	// ReferrerPolicy, eg "strict-origin-when-cross-origin"
+	ReferrerPolicy string
+	// ContentSecurityPolicy may contain the placeholder {nonce}, eg "script-src 'self' 'nonce-{nonce}'",
+	// in which case a new nonce is generated for every response. HandleStaticFiles adds the nonce to the
+	// <script> and <style> tags of index.html, and a template can use it as {{.Nonce}}. See also CSPNonce.
+	ContentSecurityPolicy string
+	// CSPReportOnly sends the policy as Content-Security-Policy-Report-Only, so that you can see what would break before enforcing it.
+	CSPReportOnly bool
+}
+
+// RecommendedSecurityHeaders is a reasonable starting point for DefaultSecurityHeaders.
+// The Content-Security-Policy only allows resources from our own origin, so you will probably need to add the hosts
+// of external resources such as map tiles.
+var RecommendedSecurityHeaders = SecurityHeaders{
+	HSTS:                  365 * 24 * time.Hour,
+	NoSniff:               true,
+	FrameOptions:          "SAMEORIGIN",
+	ReferrerPolicy:        "strict-origin-when-cross-origin",
+	ContentSecurityPolicy: "default-src 'self'; script-src 'self' 'nonce-{nonce}'; style-src 'self' 'unsafe-inline'; img-src 'self' data: blob:; object-src 'none'; base-uri 'self'",
+}
+
+// DefaultSecurityHeaders are the security headers of every route registered through nf (including HandleStaticFiles),
+// unless the route has its own Security option. If nil (the default), then no security headers are sent.
+// Like BypassAuth, this must be set before your routes are registered.
+var DefaultSecurityHeaders *SecurityHeaders
+
+// Security sets the security headers of a route, overriding DefaultSecurityHeaders. Pass nil to send no security headers.
+func Security(headers *SecurityHeaders) RouteOption {
+	return func(r *Route) {
+		r.security = headers
+	}
+}
+
+type cspNonceKey struct{}
+
+// CSPNonce returns the Content-Security-Policy nonce of the request, or an empty string if the route's policy has no nonce.
+// Use this if a handler produces HTML with inline scripts.
+func CSPNonce(r *http.Request) string {
+	nonce, _ := r.Context().Value(cspNonceKey{}).(string)
+	return nonce
+}
+
+func (s *SecurityHeaders) usesNonce() bool {
+	return strings.Contains(s.ContentSecurityPolicy, "{nonce}")
+}
+
+func (s *SecurityHeaders) frameAncestors() string {
+	switch strings.ToUpper(s.FrameOptions) {
+	case "DENY":
+		return "frame-ancestors 'none'"
+	case "SAMEORIGIN":
+		return "frame-ancestors 'self'"
+	}
+	return ""
+}
+
+// setHeaders adds the security headers to the response. If the policy has a nonce, then the returned request
+// carries the nonce in its context (see CSPNonce).
+func (s *SecurityHeaders) setHeaders(w http.ResponseWriter, r *http.Request) *http.Request {
+	h := w.Header()
+	if s.HSTS > 0 {
+		hsts := "max-age=" + strconv.FormatInt(int64(s.HSTS.Seconds()), 10)
+		if s.HSTSIncludeSubdomains {
+			hsts += "; includeSubDomains"
+		}
+		h.Set("Strict-Transport-Security", hsts)
+	}
+	if s.NoSniff {
+		h.Set("X-Content-Type-Options", "nosniff")
+	}
+	if s.FrameOptions != "" {
+		h.Set("X-Frame-Options", strings.ToUpper(s.FrameOptions))
+	}
+	if s.ReferrerPolicy != "" {
+		h.Set("Referrer-Policy", s.ReferrerPolicy)
+	}
+	csp := s.ContentSecurityPolicy
+	if ancestors := s.frameAncestors(); ancestors != "" && !strings.Contains(csp, "frame-ancestors") {
+		if csp != "" {
+			csp = strings.TrimRight(csp, "; ") + "; "
+		}
+		csp += ancestors
+	}
+	if csp != "" {
+		if s.usesNonce() {
+			nonce := newRandomToken()
+			csp = strings.ReplaceAll(csp, "{nonce}", nonce)
+			r = r.WithContext(context.WithValue(r.Context(), cspNonceKey{}, nonce))
+		}
+		if s.CSPReportOnly {
+			h.Set("Content-Security-Policy-Report-Only", csp)
+		} else {
+			h.Set("Content-Security-Policy", csp)
+		}
+	}
+	return r
+}
+
+// newRandomToken returns 128 random bits, for CSP nonces, request IDs and Idempotency-Keys
+func newRandomToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,45 @@
+package nf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/julienschmidt/httprouter"
+	"gotest.tools/v3/assert"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	headers := RecommendedSecurityHeaders
+	router := httprouter.New()
+	Handle(router, "GET", "/api/x", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) { SendOK(w) }, Security(&headers))
+	Handle(router, "GET", "/api/plain", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) { SendOK(w) })
+	HandleStaticFilesFS(router, "/app", fstest.MapFS{
+		"index.html": {Data: []byte(`<html><script>boot()</script><script src="main.js"></script><style>a{}</style></html>`)},
+	}, StaticSecurity(&headers))
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	w := get("/api/x")
+	assert.Equal(t, w.Header().Get("Strict-Transport-Security"), "max-age=31536000")
+	assert.Equal(t, w.Header().Get("X-Content-Type-Options"), "nosniff")
+	assert.Equal(t, w.Header().Get("X-Frame-Options"), "SAMEORIGIN")
+	assert.Equal(t, w.Header().Get("Referrer-Policy"), "strict-origin-when-cross-origin")
+	assert.Assert(t, strings.HasSuffix(w.Header().Get("Content-Security-Policy"), "; frame-ancestors 'self'"))
+	assert.Equal(t, get("/api/plain").Header().Get("X-Frame-Options"), "")
+
+	w = get("/app/somewhere")
+	nonce := regexp.MustCompile(`'nonce-([^']+)'`).FindStringSubmatch(w.Header().Get("Content-Security-Policy"))
+	assert.Assert(t, nonce != nil)
+	n := nonce[1]
+	assert.Equal(t, w.Body.String(), `<html><script nonce="`+n+`">boot()</script><script nonce="`+n+`" src="main.js"></script><style nonce="`+n+`">a{}</style></html>`)
+	assert.Equal(t, w.Header().Get("Cache-Control"), "no-store")
+	assert.Assert(t, get("/app/somewhere").Header().Get("Content-Security-Policy") != w.Header().Get("Content-Security-Policy"))
+}
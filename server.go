@@ -0,0 +1,196 @@
+package nf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/IMQS/log"
+)
+
+// DefaultShutdownTimeout is used when Server.ShutdownTimeout is zero.
+var DefaultShutdownTimeout = 30 * time.Second
+
+// Server owns the HTTP listeners of a service, and shuts them down gracefully.
+//
+// Typical usage from main():
+//
+//	server := nf.NewServer(router, ":2000")
+//	server.Log = log
+//	server.AddShutdownHook("db", func(ctx context.Context) error { return db.Close() })
+//	if err := server.Run(); err != nil {
+//		log.Errorf("%v", err)
+//	}
+type Server struct {
+	Handler         http.Handler
+	Addrs           []string      // eg ":80", or "127.0.0.1:2000"
+	ShutdownTimeout time.Duration // How long to wait for in-flight requests to finish, and again for the shutdown hooks. If zero, then DefaultShutdownTimeout.
+	Log             *log.Logger   // Optional
+
+	lock         sync.Mutex
+	hooks        []shutdownHook
+	shuttingDown bool
+}
+
+type shutdownHook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// NewServer creates a server that will serve handler on all of addrs.
+func NewServer(handler http.Handler, addrs ...string) *Server {
+	return &Server{
+		Handler: handler,
+		Addrs:   addrs,
+	}
+}
+
+// AddShutdownHook registers fn to run after all in-flight requests have finished.
+// Hooks run in the order in which they were added, so add them in the reverse order of their dependencies
+// (eg stop background workers before closing the database).
+func (s *Server) AddShutdownHook(name string, fn func(ctx context.Context) error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.hooks = append(s.hooks, shutdownHook{name, fn})
+}
+
+// ShuttingDown returns true once the server has started to shut down.
+func (s *Server) ShuttingDown() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.shuttingDown
+}
+
+// Run calls Serve from inside RunServiceContext, so that the server stops when the Windows service manager
+// asks us to stop, or when we receive SIGINT or SIGTERM.
+// If Serve fails before it is asked to stop, then the error is logged, because a Windows service exits without
+// returning from Run (see RunServiceContext).
+func (s *Server) Run() error {
+	var err error
+	RunServiceContext(func(ctx context.Context) {
+		err = s.Serve(ctx)
+		if err != nil && ctx.Err() == nil {
+			s.errorf("%v", err)
+		}
+	})
+	return err
+}
+
+type serverShutdownKey struct{}
+
+// ServerShutdown returns a channel that is closed when the Server that is serving r starts to shut down.
+// Long-lived handlers, such as event streams and long polls, must return when this happens, otherwise the shutdown
+// waits for them until ShutdownTimeout. SSE.Done does this for you.
+// Returns nil (which blocks forever in a select) if r is not being served by a Server.
+func ServerShutdown(r *http.Request) <-chan struct{} {
+	ch, _ := r.Context().Value(serverShutdownKey{}).(chan struct{})
+	return ch
+}
+
+// Serve listens on all of the server's addresses, and blocks until ctx is cancelled, or one of the listeners fails.
+// It then stops accepting new connections, waits for in-flight requests to finish, and runs the shutdown hooks.
+func (s *Server) Serve(ctx context.Context) error {
+	if len(s.Addrs) == 0 {
+		return errors.New("Server has no addresses to listen on")
+	}
+
+	// Open all listeners up front, so that a bad address fails immediately
+	listeners := []net.Listener{}
+	for _, addr := range s.Addrs {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return fmt.Errorf("Failed to listen on %v: %v", addr, err)
+		}
+		listeners = append(listeners, ln)
+	}
+
+	servers := []*http.Server{}
+	serveErr := make(chan error, len(listeners))
+	shutdown := make(chan struct{})
+	closeShutdown := sync.OnceFunc(func() { close(shutdown) })
+	baseCtx := context.WithValue(context.Background(), serverShutdownKey{}, shutdown)
+	for _, ln := range listeners {
+		srv := &http.Server{
+			Handler:     s.Handler,
+			BaseContext: func(net.Listener) context.Context { return baseCtx },
+		}
+		srv.RegisterOnShutdown(closeShutdown)
+		servers = append(servers, srv)
+		s.infof("Listening on %v", ln.Addr())
+		go func(ln net.Listener) {
+			if err := srv.Serve(ln); err != http.ErrServerClosed {
+				serveErr <- err
+			}
+		}(ln)
+	}
+
+	var firstErr error
+	select {
+	case <-ctx.Done():
+		s.infof("Shutting down")
+	case firstErr = <-serveErr:
+		s.errorf("HTTP server failed, shutting down: %v", firstErr)
+	}
+
+	s.lock.Lock()
+	s.shuttingDown = true
+	hooks := s.hooks
+	s.lock.Unlock()
+
+	timeout := s.ShutdownTimeout
+	if timeout == 0 {
+		timeout = DefaultShutdownTimeout
+	}
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	wg := sync.WaitGroup{}
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(drainCtx); err != nil {
+				s.warnf("Timed out waiting for in-flight requests to finish. Closing connections.")
+				srv.Close()
+			}
+		}(srv)
+	}
+	wg.Wait()
+
+	hookCtx, cancelHooks := context.WithTimeout(context.Background(), timeout)
+	defer cancelHooks()
+	errs := []error{firstErr}
+	for _, h := range hooks {
+		s.infof("Running shutdown hook %v", h.name)
+		if err := h.fn(hookCtx); err != nil {
+			s.errorf("Shutdown hook %v failed: %v", h.name, err)
+			errs = append(errs, fmt.Errorf("Shutdown hook %v: %w", h.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Server) infof(format string, args ...interface{}) {
+	if s.Log != nil {
+		s.Log.Infof(format, args...)
+	}
+}
+
+func (s *Server) warnf(format string, args ...interface{}) {
+	if s.Log != nil {
+		s.Log.Warnf(format, args...)
+	}
+}
+
+func (s *Server) errorf(format string, args ...interface{}) {
+	if s.Log != nil {
+		s.Log.Errorf(format, args...)
+	}
+}
@@ -0,0 +1,96 @@
+package nf
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"gotest.tools/v3/assert"
+)
+
+// freeAddr returns an address that nobody is listening on
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestServerShutdown(t *testing.T) {
+	broker := NewSSEBroker(0)
+	router := httprouter.New()
+	Handle(router, "GET", "/server/events", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		broker.Serve(w, r, nil)
+	}, Timeout(0))
+
+	addr := freeAddr(t)
+	server := NewServer(router, addr)
+	server.ShutdownTimeout = 5 * time.Second
+	hookRan := false
+	server.AddShutdownHook("test", func(ctx context.Context) error {
+		hookRan = true
+		return nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() { served <- server.Serve(ctx) }()
+
+	// Open an event stream, which would hold up the shutdown if it wasn't told about it
+	var resp *http.Response
+	var err error
+	for i := 0; i < 50; i++ {
+		if resp, err = http.Get("http://" + addr + "/server/events"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NilError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 200)
+	for broker.Subscribers() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+	cancel()
+	assert.NilError(t, <-served)
+	assert.Assert(t, time.Since(start) < 2*time.Second, "Shutdown waited %v for the event stream", time.Since(start))
+	assert.Assert(t, hookRan)
+	assert.Assert(t, server.ShuttingDown())
+}
+
+func TestServerListenFailure(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer ln.Close()
+	server := NewServer(http.NotFoundHandler(), ln.Addr().String())
+	err = server.Serve(context.Background())
+	assert.Assert(t, err != nil && strings.HasPrefix(err.Error(), "Failed to listen on"), "%v", err)
+}
+
+func TestRunServiceContextExits(t *testing.T) {
+	defer func(r func(func()) bool, e func(int)) { runAsService, exit = r, e }(runAsService, exit)
+
+	// Unlike gowinsvc, our fake service manager returns once the handler has finished, so that the test can end
+	exitCode := make(chan int, 1)
+	runAsService = func(handler func()) bool {
+		handler()
+		return true
+	}
+	exit = func(code int) {
+		exitCode <- code
+	}
+	RunServiceContext(func(ctx context.Context) {
+		// eg the port is already in use
+	})
+	select {
+	case code := <-exitCode:
+		assert.Equal(t, code, 1)
+	default:
+		t.Fatal("RunServiceContext did not exit when run returned")
+	}
+}
@@ -1,7 +1,11 @@
 package nf
 
 import (
+	"context"
 	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
 
 	"github.com/IMQS/gowinsvc/service"
 )
@@ -14,9 +18,50 @@ func IsRunningInContainer() bool {
 }
 
 // RunService runs 'run' as a service on Windows, but if that fails, then falls back to running in the foreground.
+// 'run' is never told to stop. If your service needs to shut down cleanly, use RunServiceContext instead.
 func RunService(run func()) {
-	if !service.RunAsService(run) {
+	if !runAsService(run) {
 		// Run in the foreground
 		run()
 	}
 }
+
+// RunServiceContext is like RunService, but the context passed to 'run' is cancelled when the Windows service
+// manager asks us to stop, or when we receive SIGINT or SIGTERM. RunServiceContext only returns once 'run' has returned.
+//
+// If 'run' returns by itself while we're running as a Windows service (eg because it failed to open its port), then
+// the process exits with status 1, because the service manager would otherwise believe that we are still running.
+// Log the reason before returning from 'run'.
+func RunServiceContext(run func(ctx context.Context)) {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	done := make(chan struct{})
+	var stopRequested atomic.Bool
+	asService := func() {
+		defer close(done)
+		run(ctx)
+		if !stopRequested.Load() {
+			if ctx.Err() != nil {
+				// SIGINT or SIGTERM
+				exit(0)
+			}
+			exit(1)
+		}
+	}
+	if runAsService(asService) {
+		// RunAsService returns as soon as the service manager asks us to stop, but 'run' is
+		// still busy on another goroutine, so we need to tell it to stop, and wait for it.
+		stopRequested.Store(true)
+		cancel()
+		<-done
+	} else {
+		// Run in the foreground
+		run(ctx)
+	}
+}
+
+// These are variables so that tests can pretend to be the Windows service manager
+var (
+	runAsService = service.RunAsService
+	exit         = os.Exit
+)
@@ -0,0 +1,285 @@
+package nf
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultSSEHeartbeat is the interval between the keep-alive comments of an event stream, so that proxies
+// don't close an idle connection, and so that we notice when a client has gone away.
+var DefaultSSEHeartbeat = 15 * time.Second
+
+// SSEEvent is a single Server-Sent Event. See https://html.spec.whatwg.org/multipage/server-sent-events.html
+type SSEEvent struct {
+	ID    string // Sent back to us by the browser, as Last-Event-ID, when it reconnects
+	Event string // The event type. If empty, then the browser dispatches a "message" event.
+	Data  string // May contain newlines
+	Retry time.Duration
+}
+
+var sseConnections = DefaultMetrics.NewGauge("nf_sse_connections", "Number of open Server-Sent Event streams.")
+
+// SSE is a Server-Sent Events stream. Register the route with Timeout(0), otherwise DefaultTimeout will end the stream.
+//
+// A typical handler:
+//
+//	sse := nf.NewSSE(w, r)
+//	for {
+//		select {
+//		case change := <-changes:
+//			if sse.SendJSON("change", change) != nil {
+//				return
+//			}
+//		case <-sse.Done():
+//			return
+//		}
+//	}
+//
+// But for fanning out events to many clients, use SSEBroker, which does all of this for you, including heartbeats.
+type SSE struct {
+	// LastEventID is the ID of the last event that the client received, if it is reconnecting.
+	// Use this to send the events that it missed.
+	LastEventID string
+
+	w    http.ResponseWriter
+	r    *http.Request
+	rc   *http.ResponseController
+	done <-chan struct{}
+	lock sync.Mutex
+}
+
+// NewSSE sends the headers of an event stream.
+func NewSSE(w http.ResponseWriter, r *http.Request) *SSE {
+	s := &SSE{
+		w:           w,
+		r:           r,
+		rc:          http.NewResponseController(w),
+		LastEventID: r.Header.Get("Last-Event-ID"),
+	}
+	if s.LastEventID == "" {
+		// Some EventSource polyfills can't set headers
+		s.LastEventID = r.URL.Query().Get("lastEventId")
+	}
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	// Stop nginx (and the IMQS router, if it's behind nginx) from buffering the stream
+	h.Set("X-Accel-Buffering", "no")
+	// The server's WriteTimeout would end the stream. This fails if the writer doesn't support it, which is fine.
+	s.rc.SetWriteDeadline(time.Time{})
+	w.WriteHeader(http.StatusOK)
+	s.rc.Flush()
+
+	s.done = r.Context().Done()
+	if shutdown := ServerShutdown(r); shutdown != nil {
+		done := make(chan struct{})
+		go func() {
+			// The request context is always cancelled once the handler returns, so this doesn't leak
+			select {
+			case <-r.Context().Done():
+			case <-shutdown:
+			}
+			close(done)
+		}()
+		s.done = done
+	}
+	return s
+}
+
+// Done is closed when the client disconnects, or when the Server is shutting down (see ServerShutdown).
+func (s *SSE) Done() <-chan struct{} {
+	return s.done
+}
+
+// Send sends an event, and flushes it to the client. An error means that the client has gone away.
+func (s *SSE) Send(e SSEEvent) error {
+	var b strings.Builder
+	if e.ID != "" {
+		b.WriteString("id: " + sseSingleLine(e.ID) + "\n")
+	}
+	if e.Event != "" {
+		b.WriteString("event: " + sseSingleLine(e.Event) + "\n")
+	}
+	if e.Retry > 0 {
+		b.WriteString("retry: " + strconv.FormatInt(e.Retry.Milliseconds(), 10) + "\n")
+	}
+	// A bare "\r" is also a line break, which would otherwise allow the injection of other fields
+	data := strings.ReplaceAll(strings.ReplaceAll(e.Data, "\r\n", "\n"), "\r", "\n")
+	for _, line := range strings.Split(data, "\n") {
+		b.WriteString("data: " + line + "\n")
+	}
+	b.WriteString("\n")
+	return s.write(b.String())
+}
+
+// SendJSON sends obj, encoded as JSON, as the data of an event of the given type.
+func (s *SSE) SendJSON(event string, obj interface{}) error {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	return s.Send(SSEEvent{Event: event, Data: string(data)})
+}
+
+// Heartbeat sends a comment, which the browser ignores. An error means that the client has gone away.
+func (s *SSE) Heartbeat() error {
+	return s.write(":\n\n")
+}
+
+func (s *SSE) write(msg string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.r.Context().Err(); err != nil {
+		return err
+	}
+	if _, err := s.w.Write([]byte(msg)); err != nil {
+		return err
+	}
+	return s.rc.Flush()
+}
+
+// sseSingleLine prevents a newline from ending a field early, which would allow the injection of other fields
+func sseSingleLine(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
+
+// SSEBroker fans out events to all of the clients that are subscribed to it. It keeps the most recent events,
+// so that a client that reconnects receives the events that it missed in the meantime.
+type SSEBroker struct {
+	Heartbeat time.Duration // If zero, then DefaultSSEHeartbeat
+
+	lock        sync.Mutex
+	nextID      int64
+	history     []SSEEvent
+	maxHistory  int
+	subscribers map[*sseSubscriber]bool
+}
+
+type sseSubscriber struct {
+	events chan SSEEvent
+	filter func(e SSEEvent) bool
+}
+
+// sseSubscriberBuffer is the number of events that may be waiting for a slow client. If the client falls further
+// behind than that, then we disconnect it, and it catches up from the history when it reconnects.
+const sseSubscriberBuffer = 64
+
+// NewSSEBroker creates a broker that remembers the most recent 'history' events.
+func NewSSEBroker(history int) *SSEBroker {
+	return &SSEBroker{
+		maxHistory:  history,
+		subscribers: map[*sseSubscriber]bool{},
+	}
+}
+
+// Publish sends an event to all subscribers. If data is not a string, then it is encoded as JSON.
+// The event ID is assigned by the broker.
+func (b *SSEBroker) Publish(event string, data interface{}) error {
+	text, ok := data.(string)
+	if !ok {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		text = string(raw)
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.nextID++
+	e := SSEEvent{ID: strconv.FormatInt(b.nextID, 10), Event: event, Data: text}
+	if b.maxHistory > 0 {
+		if len(b.history) == b.maxHistory {
+			b.history = append(b.history[:0], b.history[1:]...)
+		}
+		b.history = append(b.history, e)
+	}
+	for sub := range b.subscribers {
+		if sub.filter != nil && !sub.filter(e) {
+			continue
+		}
+		select {
+		case sub.events <- e:
+		default:
+			// Too slow. Closing the channel ends its stream.
+			delete(b.subscribers, sub)
+			close(sub.events)
+		}
+	}
+	return nil
+}
+
+// Subscribers returns the number of connected clients.
+func (b *SSEBroker) Subscribers() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.subscribers)
+}
+
+// Serve streams events to the client until it disconnects. If filter is not nil, then only the events for which
+// it returns true are sent, which is how you send events only to the users that are allowed to see them.
+//
+//	nf.HandleAuthenticated(router, "GET", "/api/events", func(w http.ResponseWriter, r *http.Request, p httprouter.Params, auth *serviceauth.Token) {
+//		broker.Serve(w, r, nil)
+//	}, nil, nf.Timeout(0))
+func (b *SSEBroker) Serve(w http.ResponseWriter, r *http.Request, filter func(e SSEEvent) bool) {
+	sse := NewSSE(w, r)
+	sub := &sseSubscriber{
+		events: make(chan SSEEvent, sseSubscriberBuffer),
+		filter: filter,
+	}
+
+	// Subscribe and collect the missed events atomically, so that we neither lose nor duplicate an event
+	b.lock.Lock()
+	var missed []SSEEvent
+	if last, err := strconv.ParseInt(sse.LastEventID, 10, 64); err == nil {
+		for _, e := range b.history {
+			if id, _ := strconv.ParseInt(e.ID, 10, 64); id > last && (filter == nil || filter(e)) {
+				missed = append(missed, e)
+			}
+		}
+	}
+	b.subscribers[sub] = true
+	b.lock.Unlock()
+
+	sseConnections.Inc()
+	defer func() {
+		sseConnections.Dec()
+		b.lock.Lock()
+		if b.subscribers[sub] {
+			delete(b.subscribers, sub)
+			close(sub.events)
+		}
+		b.lock.Unlock()
+	}()
+
+	for _, e := range missed {
+		if sse.Send(e) != nil {
+			return
+		}
+	}
+
+	heartbeat := b.Heartbeat
+	if heartbeat == 0 {
+		heartbeat = DefaultSSEHeartbeat
+	}
+	ticker := time.NewTicker(heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case e, ok := <-sub.events:
+			if !ok || sse.Send(e) != nil {
+				return
+			}
+		case <-ticker.C:
+			if sse.Heartbeat() != nil {
+				return
+			}
+		case <-sse.Done():
+			return
+		}
+	}
+}
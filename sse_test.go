@@ -0,0 +1,75 @@
+package nf
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"gotest.tools/v3/assert"
+)
+
+func TestSSEBroker(t *testing.T) {
+	broker := NewSSEBroker(10)
+	router := httprouter.New()
+	Handle(router, "GET", "/events", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		broker.Serve(w, r, func(e SSEEvent) bool { return e.Event != "secret" })
+	}, Timeout(0))
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	connect := func(lastEventID string) (*bufio.Reader, context.CancelFunc) {
+		ctx, cancel := context.WithCancel(context.Background())
+		req, _ := http.NewRequestWithContext(ctx, "GET", server.URL+"/events", nil)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.NilError(t, err)
+		assert.Equal(t, resp.Header.Get("Content-Type"), "text/event-stream")
+		return bufio.NewReader(resp.Body), cancel
+	}
+	readEvent := func(r *bufio.Reader) string {
+		lines := []string{}
+		for {
+			line, err := r.ReadString('\n')
+			assert.NilError(t, err)
+			if line == "\n" {
+				return strings.Join(lines, "|")
+			}
+			lines = append(lines, strings.TrimSuffix(line, "\n"))
+		}
+	}
+	waitForSubscribers := func(n int) {
+		for i := 0; i < 100 && broker.Subscribers() != n; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(t, broker.Subscribers(), n)
+	}
+
+	stream, cancel := connect("")
+	waitForSubscribers(1)
+	broker.Publish("change", map[string]int{"id": 5})
+	broker.Publish("secret", "hidden")
+	broker.Publish("", "line 1\nline 2")
+	assert.Equal(t, readEvent(stream), `id: 1|event: change|data: {"id":5}`)
+	assert.Equal(t, readEvent(stream), "id: 3|data: line 1|data: line 2")
+	cancel()
+	waitForSubscribers(0)
+
+	// Resume after event 1
+	stream, cancel = connect("1")
+	defer cancel()
+	assert.Equal(t, readEvent(stream), "id: 3|data: line 1|data: line 2")
+}
+
+func TestSSESend(t *testing.T) {
+	w := httptest.NewRecorder()
+	s := NewSSE(w, httptest.NewRequest("GET", "/events", nil))
+	assert.NilError(t, s.Send(SSEEvent{ID: "1\r\nid: 2", Event: "a\rb", Data: "x\ry\r\nz\nevent: injected"}))
+	assert.Equal(t, w.Body.String(), "id: 1  id: 2\nevent: a b\ndata: x\ndata: y\ndata: z\ndata: event: injected\n\n")
+}
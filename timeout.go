@@ -0,0 +1,91 @@
+package nf
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/IMQS/serviceauth"
+)
+
+// DefaultTimeout is the timeout of every route registered through nf, unless the route has its own Timeout option.
+// If zero (the default), then routes have no timeout.
+// Like BypassAuth, this must be set before your routes are registered.
+var DefaultTimeout time.Duration
+
+// StatusClientClosedRequest is recorded when the client disconnects before the handler is finished.
+// This is not an official HTTP status code, but it's the one used by nginx.
+const StatusClientClosedRequest = 499
+
+// Timeout sets a deadline on the context of every request to a route, overriding DefaultTimeout.
+// A timeout of zero means no deadline. Another service that sends RequestTimeoutHeader can shorten the deadline of an
+// authenticated route, but not extend it.
+//
+// The deadline is cooperative: your handler must pass r.Context() down to anything that may block, such as
+// nfdb.BeginTx, or http.NewRequestWithContext. If the handler panics or returns without sending a response after
+// the deadline has passed, then the client receives 503 Service Unavailable.
+func Timeout(timeout time.Duration) RouteOption {
+	return func(r *Route) {
+		r.timeout = timeout
+	}
+}
+
+// withTimeout returns r with the route's deadline applied to its context
+func (route *Route) withTimeout(r *http.Request) (*http.Request, context.CancelFunc) {
+	if route.timeout == 0 {
+		return r, func() {}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), route.timeout)
+	return r.WithContext(ctx), cancel
+}
+
+// withCallerTimeout returns r with its deadline shortened to the one in RequestTimeoutHeader, if the caller is another
+// service. We don't trust the header from anybody else, because any client could then cut a route short.
+func withCallerTimeout(r *http.Request, auth *serviceauth.Token) (*http.Request, context.CancelFunc) {
+	if auth == nil || !auth.IsInterService {
+		return r, func() {}
+	}
+	ms, err := strconv.ParseInt(r.Header.Get(RequestTimeoutHeader), 10, 64)
+	if err != nil || ms <= 0 {
+		return r, func() {}
+	}
+	// If the route's own deadline is sooner, then WithTimeout keeps it
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(ms)*time.Millisecond)
+	return r.WithContext(ctx), cancel
+}
+
+// sendContextError sends the appropriate response when a request's context is done
+func sendContextError(w http.ResponseWriter, err error) {
+	if err == context.DeadlineExceeded {
+		http.Error(w, "Request timed out", http.StatusServiceUnavailable)
+	} else {
+		// The client has gone away, so nobody will see this, but it shows up in the metrics
+		http.Error(w, "Client closed request", StatusClientClosedRequest)
+	}
+}
+
+// responseStarted returns true if a response has already been started through w, or any of the writers it wraps
+func responseStarted(w http.ResponseWriter) bool {
+	for {
+		switch x := w.(type) {
+		case *statusWriter:
+			if x.status != 0 {
+				return true
+			}
+		case *compressWriter:
+			if x.status != 0 || x.decided || len(x.buf) != 0 {
+				return true
+			}
+		case *recordingWriter:
+			if x.status != 0 {
+				return true
+			}
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return false
+		}
+		w = u.Unwrap()
+	}
+}
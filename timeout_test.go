@@ -0,0 +1,109 @@
+package nf
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/IMQS/serviceauth"
+	"github.com/julienschmidt/httprouter"
+	"gotest.tools/v3/assert"
+)
+
+func TestTimeout(t *testing.T) {
+	router := httprouter.New()
+	Handle(router, "GET", "/timeout/return", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		<-r.Context().Done()
+	}, Timeout(20*time.Millisecond))
+	Handle(router, "GET", "/timeout/panic", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		<-r.Context().Done()
+		panic(r.Context().Err())
+	}, Timeout(20*time.Millisecond))
+	Handle(router, "GET", "/timeout/written", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		SendText(w, "partial")
+		<-r.Context().Done()
+		panic(r.Context().Err())
+	}, Timeout(20*time.Millisecond))
+
+	get := func(path string, ctx context.Context) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil).WithContext(ctx))
+		return w
+	}
+
+	// A route past its deadline returns 503, whether the handler returns or panics
+	for _, path := range []string{"/timeout/return", "/timeout/panic"} {
+		w := get(path, context.Background())
+		assert.Equal(t, w.Code, http.StatusServiceUnavailable, path)
+		assert.Equal(t, w.Body.String(), "Request timed out\n", path)
+	}
+
+	// A client that goes away gets no 200
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(5*time.Millisecond, cancel)
+	w := get("/timeout/panic", ctx)
+	assert.Equal(t, w.Code, StatusClientClosedRequest)
+
+	// A response that has already been sent is left alone
+	w = get("/timeout/written", context.Background())
+	assert.Equal(t, w.Code, 200)
+	assert.Equal(t, w.Body.String(), "partial")
+}
+
+func TestCallerTimeout(t *testing.T) {
+	deadline := func(r *http.Request, auth *serviceauth.Token) time.Duration {
+		r, cancel := withCallerTimeout(r, auth)
+		defer cancel()
+		d, ok := r.Context().Deadline()
+		if !ok {
+			return 0
+		}
+		return time.Until(d)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(RequestTimeoutHeader, "50")
+
+	// Only another service may shorten our deadline
+	assert.Equal(t, deadline(r, nil), time.Duration(0))
+	assert.Equal(t, deadline(r, &serviceauth.Token{UserId: 1}), time.Duration(0))
+	d := deadline(r, &serviceauth.Token{IsInterService: true})
+	assert.Assert(t, d > 0 && d <= 50*time.Millisecond, "deadline is %v", d)
+
+	// It cannot extend the deadline of the route
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	d = deadline(r.WithContext(ctx), &serviceauth.Token{IsInterService: true})
+	assert.Assert(t, d <= 10*time.Millisecond, "deadline is %v", d)
+
+	r.Header.Set(RequestTimeoutHeader, "nonsense")
+	assert.Equal(t, deadline(r, &serviceauth.Token{IsInterService: true}), time.Duration(0))
+
+	// Through a route, only a service that authenticated as such can cut it short
+	stubAuth(t, map[string]*serviceauth.Token{
+		"service": {IsInterService: true},
+		"user":    {UserId: 1},
+	})
+	var remaining time.Duration
+	router := httprouter.New()
+	HandleAuthenticated(router, "GET", "/timeout/caller", func(w http.ResponseWriter, r *http.Request, p httprouter.Params, auth *serviceauth.Token) {
+		remaining = 0
+		if d, ok := r.Context().Deadline(); ok {
+			remaining = time.Until(d)
+		}
+		SendOK(w)
+	}, nil, Timeout(time.Minute))
+	get := func(auth string) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/timeout/caller", nil)
+		req.Header.Set("Authorization", auth)
+		req.Header.Set(RequestTimeoutHeader, "50")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, w.Code, 200)
+	}
+	get("service")
+	assert.Assert(t, remaining > 0 && remaining <= 50*time.Millisecond, "remaining is %v", remaining)
+	get("user")
+	assert.Assert(t, remaining > 50*time.Second, "remaining is %v", remaining)
+}
@@ -0,0 +1,319 @@
+package nf
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// DefaultMaxUploadSize is the limit of UploadConfig.MaxTotalSize, if it is zero.
+var DefaultMaxUploadSize int64 = 100 * 1024 * 1024
+
+// maxUploadFieldSize limits the size of each non-file form field, which is held in memory
+const maxUploadFieldSize = 1024 * 1024
+
+// UploadConfig controls ReadUpload.
+type UploadConfig struct {
+	MaxFileSize  int64 // Maximum size of a single file. If zero, then only MaxTotalSize applies.
+	MaxTotalSize int64 // Maximum size of the entire request body. If zero, then DefaultMaxUploadSize.
+	// AllowedTypes are the MIME types that may be uploaded, eg "application/pdf". An entry that ends with a slash,
+	// such as "image/", allows all types with that prefix. If empty, then any type is allowed. See UploadedFile.ContentType.
+	AllowedTypes []string
+	TempDir      string // Directory of the temporary files. If empty, then os.TempDir()
+	// OnFile, if not nil, receives the content of every file, instead of the content being saved to a temporary file.
+	// The size limits, type check and checksum are applied as the content is read. file.Size and file.SHA256 are only
+	// valid after OnFile returns. If OnFile returns an error, then ReadUpload panics with that error.
+	OnFile func(file *UploadedFile, content io.Reader) error
+}
+
+// UploadedFile is a file from a multipart/form-data request.
+type UploadedFile struct {
+	FieldName string // Name of the form field
+	FileName  string // Name of the file on the client. Do not use this as a path on the server.
+	// ContentType is sniffed from the content. If the content is not recognizable (eg a shapefile or CSV), then the type
+	// comes from the file extension, and failing that, from the Content-Type that was sent by the client, but only if
+	// that agrees with the content (eg text/csv for text, but not image/svg+xml).
+	ContentType string
+	Size        int64
+	SHA256      string // Hex encoded
+	Path        string // The temporary file. Empty if UploadConfig.OnFile was used.
+}
+
+// Upload is the result of ReadUpload.
+type Upload struct {
+	Fields map[string][]string // The form fields that are not files
+	Files  []*UploadedFile
+
+	cleanupOnce sync.Once
+}
+
+// Open opens the temporary file of the first uploaded file with the given form field name.
+// Returns nil if there is no such file.
+func (u *Upload) Open(fieldName string) *os.File {
+	for _, f := range u.Files {
+		if f.FieldName == fieldName && f.Path != "" {
+			file, err := os.Open(f.Path)
+			Check(err)
+			return file
+		}
+	}
+	return nil
+}
+
+// Cleanup deletes the temporary files. This happens automatically when the handler of an nf route returns or panics,
+// so you only need to call this if you use ReadUpload outside of Handle and HandleAuthenticated.
+// To keep a file, move it somewhere else before your handler returns.
+func (u *Upload) Cleanup() {
+	u.cleanupOnce.Do(func() {
+		for _, f := range u.Files {
+			if f.Path != "" {
+				os.Remove(f.Path)
+			}
+		}
+	})
+}
+
+// ReadUpload reads a multipart/form-data request, streaming the files to temporary files (or to config.OnFile),
+// so that large uploads are never held in memory.
+// Panics with 413 if a size limit is exceeded, 415 if a file type is not allowed, and 400 if the request is not multipart.
+// Any temporary files that were already created are deleted before such a panic.
+func ReadUpload(r *http.Request, config UploadConfig) *Upload {
+	maxTotal := config.MaxTotalSize
+	if maxTotal == 0 {
+		maxTotal = DefaultMaxUploadSize
+	}
+	if r.Body == nil {
+		Panic(http.StatusBadRequest, "ReadUpload failed: Request body is empty")
+	}
+	r.Body = http.MaxBytesReader(nil, r.Body, maxTotal)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		Panic(http.StatusBadRequest, "ReadUpload failed: "+err.Error())
+	}
+
+	upload := &Upload{Fields: map[string][]string{}}
+	onRequestDone(r, upload.Cleanup)
+	success := false
+	defer func() {
+		if !success {
+			upload.Cleanup()
+		}
+	}()
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		checkUploadError(err)
+		if part.FileName() == "" {
+			value, err := io.ReadAll(io.LimitReader(part, maxUploadFieldSize+1))
+			checkUploadError(err)
+			if len(value) > maxUploadFieldSize {
+				Panic(http.StatusRequestEntityTooLarge, fmt.Sprintf("ReadUpload failed: Form field %v is too large", part.FormName()))
+			}
+			upload.Fields[part.FormName()] = append(upload.Fields[part.FormName()], string(value))
+			continue
+		}
+		file := &UploadedFile{
+			FieldName: part.FormName(),
+			FileName:  filepath.Base(strings.ReplaceAll(part.FileName(), "\\", "/")),
+		}
+		upload.Files = append(upload.Files, file)
+		readUploadedFile(file, part, part.Header.Get("Content-Type"), &config)
+		part.Close()
+	}
+	success = true
+	return upload
+}
+
+func readUploadedFile(file *UploadedFile, content io.Reader, declaredType string, config *UploadConfig) {
+	buffered := bufio.NewReader(content)
+	start, _ := buffered.Peek(512)
+	file.ContentType = uploadContentType(start, file.FileName, declaredType)
+	if !uploadTypeAllowed(file.ContentType, config.AllowedTypes) {
+		Panic(http.StatusUnsupportedMediaType, fmt.Sprintf("ReadUpload failed: Files of type %v are not allowed", file.ContentType))
+	}
+
+	hash := sha256.New()
+	var body io.Reader = io.TeeReader(buffered, hash)
+	if config.MaxFileSize != 0 {
+		body = &uploadLimitReader{r: body, remaining: config.MaxFileSize, name: file.FileName}
+	}
+	counter := &countingReader{r: body}
+
+	if config.OnFile != nil {
+		if err := config.OnFile(file, counter); err != nil {
+			panic(err)
+		}
+		// Whatever the callback didn't read still needs to be checked, and included in the checksum
+		_, err := io.Copy(io.Discard, counter)
+		checkUploadError(err)
+	} else {
+		tmp, err := os.CreateTemp(config.TempDir, "nf-upload-*"+uploadTempExt(file.FileName))
+		Check(err)
+		file.Path = tmp.Name()
+		_, err = io.Copy(tmp, counter)
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		checkUploadError(err)
+	}
+	file.Size = counter.n
+	file.SHA256 = hex.EncodeToString(hash.Sum(nil))
+}
+
+// uploadTempExt keeps the extension of the original file, because some libraries (eg GDAL) care about it
+func uploadTempExt(fileName string) string {
+	ext := filepath.Ext(fileName)
+	for _, c := range ext[min(1, len(ext)):] {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return ""
+		}
+	}
+	return ext
+}
+
+// uploadContentType trusts the content first, because the client can claim anything. If the content is not recognizable,
+// then the extension (or the declared type) may refine it, but only to a type that agrees with the content: text may
+// become eg text/csv, but never an image (SVG can contain scripts), and binary content may not become text.
+func uploadContentType(start []byte, fileName, declaredType string) string {
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(start))
+	if sniffed != "application/octet-stream" && sniffed != "text/plain" {
+		return sniffed
+	}
+	for _, claimed := range []string{mime.TypeByExtension(filepath.Ext(fileName)), declaredType} {
+		t, _, err := mime.ParseMediaType(claimed)
+		if err != nil {
+			continue
+		}
+		if sniffed == "text/plain" && isPlainTextType(t) || sniffed == "application/octet-stream" && !isTextType(t) {
+			return t
+		}
+	}
+	return sniffed
+}
+
+// isPlainTextType returns true for text formats that DetectContentType reports as text/plain, and which
+// don't contain anything that a browser would run
+func isPlainTextType(t string) bool {
+	switch t {
+	case "text/html", "text/xml", "text/javascript", "text/ecmascript":
+		return false
+	}
+	return strings.HasPrefix(t, "text/")
+}
+
+// isTextType returns true for any format that consists of text, such as text/csv, image/svg+xml or application/json
+func isTextType(t string) bool {
+	return strings.HasPrefix(t, "text/") || strings.Contains(t, "xml") || strings.Contains(t, "json") || strings.Contains(t, "script")
+}
+
+func uploadTypeAllowed(contentType string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, a := range allowed {
+		if strings.HasSuffix(a, "/") && strings.HasPrefix(contentType, a) || strings.EqualFold(a, contentType) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkUploadError turns the errors of our size limits into a 413, and any other error into a 400
+func checkUploadError(err error) {
+	if err == nil {
+		return
+	}
+	var maxBytes *http.MaxBytesError
+	if errors.As(err, &maxBytes) {
+		Panic(http.StatusRequestEntityTooLarge, "ReadUpload failed: Request body is too large")
+	}
+	var tooLarge *uploadTooLargeError
+	if errors.As(err, &tooLarge) {
+		Panic(http.StatusRequestEntityTooLarge, "ReadUpload failed: "+tooLarge.Error())
+	}
+	Panic(http.StatusBadRequest, "ReadUpload failed: "+err.Error())
+}
+
+type uploadTooLargeError struct {
+	name string
+}
+
+func (e *uploadTooLargeError) Error() string {
+	return fmt.Sprintf("File %v is too large", e.name)
+}
+
+type uploadLimitReader struct {
+	r         io.Reader
+	remaining int64
+	name      string
+}
+
+func (l *uploadLimitReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return 0, &uploadTooLargeError{l.name}
+	}
+	return n, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// requestCleanup holds the functions that must run when the handler of a request is finished, even if it panics
+type requestCleanup struct {
+	lock sync.Mutex
+	fns  []func()
+}
+
+type requestCleanupKey struct{}
+
+// withRequestCleanup returns a request that onRequestDone can register cleanup functions with.
+// The caller must call run when the handler is finished.
+func withRequestCleanup(r *http.Request) (*http.Request, *requestCleanup) {
+	c := &requestCleanup{}
+	return r.WithContext(context.WithValue(r.Context(), requestCleanupKey{}, c)), c
+}
+
+// onRequestDone registers fn to run when the handler of r is finished. Returns false if r did not come through an nf route.
+func onRequestDone(r *http.Request, fn func()) bool {
+	c, _ := r.Context().Value(requestCleanupKey{}).(*requestCleanup)
+	if c == nil {
+		return false
+	}
+	c.lock.Lock()
+	c.fns = append(c.fns, fn)
+	c.lock.Unlock()
+	return true
+}
+
+func (c *requestCleanup) run() {
+	c.lock.Lock()
+	fns := c.fns
+	c.fns = nil
+	c.lock.Unlock()
+	for i := len(fns) - 1; i >= 0; i-- {
+		fns[i]()
+	}
+}
@@ -0,0 +1,84 @@
+package nf
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"gotest.tools/v3/assert"
+)
+
+func TestReadUpload(t *testing.T) {
+	var tempFiles []string
+	router := httprouter.New()
+	Handle(router, "POST", "/upload", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		upload := ReadUpload(r, UploadConfig{MaxFileSize: 100, AllowedTypes: []string{"image/", "text/csv"}})
+		for _, f := range upload.Files {
+			tempFiles = append(tempFiles, f.Path)
+		}
+		assert.Equal(t, upload.Fields["description"][0], "pipes")
+		assert.Equal(t, len(upload.Files), 1)
+		f := upload.Files[0]
+		assert.Equal(t, f.FileName, "pipes.csv")
+		assert.Equal(t, f.ContentType, "text/csv")
+		assert.Equal(t, f.Size, int64(9))
+		hash := sha256.Sum256([]byte("id,size\n1"))
+		assert.Equal(t, f.SHA256, hex.EncodeToString(hash[:]))
+		content, err := os.ReadFile(f.Path)
+		assert.NilError(t, err)
+		assert.Equal(t, string(content), "id,size\n1")
+		if r.URL.Query().Get("panic") != "" {
+			panic("boom")
+		}
+		SendOK(w)
+	})
+
+	post := func(query, fileName, content string) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		mw := multipart.NewWriter(body)
+		mw.WriteField("description", "pipes")
+		fw, _ := mw.CreateFormFile("file", fileName)
+		io.WriteString(fw, content)
+		mw.Close()
+		r := httptest.NewRequest("POST", "/upload"+query, body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	assert.Equal(t, post("", "C:\\data\\pipes.csv", "id,size\n1").Code, 200)
+	assert.Equal(t, post("?panic=1", "pipes.csv", "id,size\n1").Code, 500)
+	assert.Equal(t, post("", "pipes.csv", strings.Repeat("x", 101)).Code, http.StatusRequestEntityTooLarge)
+	assert.Equal(t, post("", "pipes.png", "<html><script>alert(1)</script></html>").Code, http.StatusUnsupportedMediaType)
+
+	// The temporary files must be gone, even after a panic
+	assert.Equal(t, len(tempFiles), 2)
+	for _, fn := range tempFiles {
+		_, err := os.Stat(fn)
+		assert.Assert(t, os.IsNotExist(err))
+	}
+}
+
+func TestUploadContentType(t *testing.T) {
+	text := []byte("id,size\n1")
+	binary := []byte{0, 1, 2, 3}
+	assert.Equal(t, uploadContentType(text, "pipes.csv", ""), "text/csv")
+	assert.Equal(t, uploadContentType(text, "pipes", "text/csv"), "text/csv")
+	assert.Equal(t, uploadContentType(binary, "pipes.shp", "application/x-esri-shape"), "application/x-esri-shape")
+	assert.Equal(t, uploadContentType([]byte("\x89PNG\r\n\x1a\n"), "pipes.csv", ""), "image/png")
+
+	// Text can't pass for an image or script, and binary content can't pass for text
+	assert.Equal(t, uploadContentType([]byte(`<svg onload="alert(1)"/>`), "logo.svg", "image/svg+xml"), "text/plain")
+	assert.Equal(t, uploadContentType(text, "pipes.png", "image/png"), "text/plain")
+	assert.Equal(t, uploadContentType(text, "pipes.js", ""), "text/plain")
+	assert.Equal(t, uploadContentType(binary, "pipes.csv", "text/csv"), "application/octet-stream")
+}